@@ -31,117 +31,394 @@ import (
 	"github.com/mashedkeyboard/ybtools/v2"
 )
 
-func processArticle(w *mwclient.Client, title, text, revTS, curTS string, regexes map[*regexp.Regexp]STRegex, test bool, attempt int8) {
-	var articlePrepend strings.Builder
-	var articleAppend strings.Builder
-	var detected []string
+// How many times to retry an edit after an edit conflict, and how long to
+// wait before the first retry; each retry after that waits twice as long
+const maxEditConflictRetries int8 = 3
+
+var editConflictBackoff = 5 * time.Second
+
+// How long to wait after each edit, to keep the edit rate down
+var editDelay = 10 * time.Second
+
+// canEdit is ybtools.CanEdit, kept in a variable so that tests can stand in for the
+// kill page and edit limit checks, which go through the ybtools client.
+var canEdit = ybtools.CanEdit
+
+// ruleMatch is a single rule that has matched an article, along with what it would
+// add to the start and end of the article.
+type ruleMatch struct {
+	rule   STRegex
+	prefix string
+	suffix string
+	// uncertain is true if the rule's conditions couldn't be checked without fetching more
+	// about the page, so they still have to be checked before it's tagged
+	uncertain bool
+}
+
+// ruleSkip is a rule whose regex matched an article, but which was skipped anyway
+type ruleSkip struct {
+	rule    STRegex
+	outcome string
+}
+
+// articleMatch holds the result of running the regexes over a single article,
+// ready to be handed to editArticle.
+type articleMatch struct {
+	title     string
+	namespace int
+	text      string
+	revTS     string
+	curTS     string
+	rules     []ruleMatch
+}
+
+func processArticle(w *mwclient.Client, title, text, revTS, curTS string, regexes map[string]STRegex, test bool, attempt int8) {
+	page := fetchedPage{title: title, text: text, revTS: revTS, curTS: curTS}
+	editArticle(w, matchPage(page, regexes, test, attempt > 0), regexes, test, attempt)
+}
+
+// matchPage checks that we're allowed to edit a page, and if so runs the regexes over it.
+// Rules are only scoped if test is false, as sandbox test pages are never in scope.
+// It doesn't touch the wiki, so it's safe to call from many goroutines at once.
+// If retry is true, the page has already been counted in the metrics, so isn't counted again.
+func matchPage(page fetchedPage, regexes map[string]STRegex, test, retry bool) articleMatch {
+	title, text, revTS := page.title, page.text, page.revTS
+	match := articleMatch{title: title, namespace: page.namespace, text: text, revTS: revTS, curTS: page.curTS}
 
 	// Check for and respect nobots before we do anything else
 	if ybtools.BotAllowed(text) {
-		for regex, rsetup := range regexes {
-			match := regex.FindStringSubmatchIndex(text)
-			if match == nil {
-				continue
-			}
+		var skipped []ruleSkip
+		match.rules, skipped = matchArticle(page, regexes, test)
+		for _, skip := range skipped {
+			audit(title, skip.rule.ID, revTS, skip.outcome)
+		}
+		auditRules(title, revTS, match.rules, auditMatched)
+		if !retry {
+			metrics.pageScanned(match.rules)
+		}
+	} else {
+		audit(title, "", revTS, auditNobots)
+	}
 
-			// make sure that there are no matches of NoTagIf
-			if rsetup.UseNTI && rsetup.NoTagIf.MatchString(text) {
-				// match found; ignore this regex
-				continue
-			}
+	return match
+}
 
-			var edited bool
+// editArticle makes the edit described by match, if there is one to make.
+// Edits should only ever be made from one goroutine at a time, as they are rate limited.
+func editArticle(w *mwclient.Client, match articleMatch, regexes map[string]STRegex, test bool, attempt int8) {
+	title, text, revTS, curTS := match.title, match.text, match.revTS, match.curTS
 
-			if rsetup.Prefix != "" {
-				edited = tagIfNeeded(&articlePrepend, regex, rsetup, text, match)
-			}
-			if rsetup.Suffix != "" {
-				// set edited true if tagIfNeeded returns true; else, leave the previous value
-				edited = tagIfNeeded(&articleAppend, regex, rsetup, text, match) || edited
-			}
+	rules := settleGroups(title, revTS, confirmConditions(w, match))
+	if !test {
+		// sandbox tests are never capped, and don't count towards the caps either
+		rules = uncappedRules(title, revTS, rules)
+	}
 
-			if edited {
-				detected = append(detected, rsetup.Detected)
-			}
+	var articlePrepend strings.Builder
+	var articleAppend strings.Builder
+	var placed []ruleMatch
+	var placedText strings.Builder
+	var detected []string
+	for _, rmatch := range rules {
+		if rmatch.rule.Placement.kind == placementTop {
+			articlePrepend.WriteString(rmatch.prefix)
+		} else if rmatch.prefix != "" {
+			placed = append(placed, rmatch)
+			placedText.WriteString(rmatch.prefix)
+		}
+		articleAppend.WriteString(rmatch.suffix)
+		detected = append(detected, rmatch.rule.Detected)
+	}
+	prependText := articlePrepend.String()
+	appendText := articleAppend.String()
+
+	if prependText != "" || appendText != "" || len(placed) > 0 {
+		// there's something to edit!
+		var summaryBuilder strings.Builder
+		var detectedBits string = strings.Join(detected, "; ")
+		if test {
+			summaryBuilder.WriteString("SANDBOX: ")
 		}
+		summaryBuilder.WriteString("[[User:Yapperbot/Scantag|Scantag]] detected ")
+		summaryBuilder.WriteString(detectedBits)
+		summaryBuilder.WriteString(". Tagging article.")
+		originalText := text
 
-		if articlePrepend.Len() != 0 || articleAppend.Len() != 0 {
-			// there's something to edit!
-			var summaryBuilder strings.Builder
-			var detectedBits string = strings.Join(detected, "; ")
-			if test {
-				summaryBuilder.WriteString("SANDBOX: ")
+		// tags with the same placement go in as one block, so they stay in the same order as the rules
+		for _, block := range placementBlocks(placed) {
+			text = insertAtPlacement(text, block.tags, block.placement)
+		}
+		if prependText != "" {
+			text = insertIssueTags(text, prependText)
+		}
+		for _, rmatch := range rules {
+			if rmatch.suffix != "" {
+				text = insertSuffix(text, rmatch.suffix)
 			}
-			summaryBuilder.WriteString("[[User:Yapperbot/Scantag|Scantag]] detected ")
-			summaryBuilder.WriteString(detectedBits)
-			summaryBuilder.WriteString(". Tagging article.")
-			prependText := articlePrepend.String()
-			appendText := articleAppend.String()
-
-			// don't edit limit tests - they should never be in anything other than userspace
-			if test || ybtools.CanEdit() {
-				if prependText != "" {
-					text = insertMaintenanceTemplate(text, prependText)
-				}
-				if appendText != "" {
-					text = text + appendText
-				}
+		}
+
+		if dryRun {
+			// dry runs never touch the wiki, so they don't count towards the edit limit either
+			writeDryRunReport(title, originalText, text, summaryBuilder.String(), detected)
+			auditRules(title, revTS, rules, auditDryRun)
+			return
+		}
 
-				err := w.Edit(params.Values{
-					"title":          title,
-					"summary":        summaryBuilder.String(),
-					"bot":            "true",
-					"basetimestamp":  revTS,
-					"starttimestamp": curTS,
-					"text":           text,
-					"md5":            fmt.Sprintf("%x", md5.Sum([]byte(text))),
-				})
-				if err == nil {
-					log.Println("Edited", title, "with", detectedBits)
-					time.Sleep(10 * time.Second)
-				} else {
-					switch err.(type) {
-					case mwclient.APIError:
-						switch err.(mwclient.APIError).Code {
-						case "noedit", "writeapidenied", "blocked":
-							ybtools.PanicErr("noedit/writeapidenied/blocked code returned, the bot may have been blocked. Dying")
-						case "pagedeleted":
-							log.Println("Page", title, "was deleted before we could get to it")
-						case "protectedpage":
-							log.Println("Page", title, "is protected; we detected", detectedBits)
-							// future TODO: post to talk page, maybe?
-						case "editconflict":
-							if attempt < 3 {
-								processArticle(w, title, text, revTS, curTS, regexes, test, attempt+1)
-								return
-							}
-							// we've already tried three times, we've edit conflicted every time
-							// not worth it, just ignore the article for now; we'll come back later
+		// don't edit limit tests - they should never be in anything other than userspace
+		if test || canEdit() {
+			err := w.Edit(params.Values{
+				"title":          title,
+				"summary":        summaryBuilder.String(),
+				"bot":            "true",
+				"basetimestamp":  revTS,
+				"starttimestamp": curTS,
+				"text":           text,
+				"md5":            fmt.Sprintf("%x", md5.Sum([]byte(text))),
+			})
+			if err == nil {
+				log.Println("Edited", title, "with", detectedBits)
+				auditRules(title, revTS, rules, auditEdited)
+				metrics.edited()
+				if !test {
+					recordRuleEdits(rules)
+				}
+				time.Sleep(editDelay)
+			} else {
+				metrics.apiCallFailed(err)
+				switch err.(type) {
+				case mwclient.APIError:
+					switch err.(mwclient.APIError).Code {
+					case "noedit", "writeapidenied", "blocked":
+						ybtools.PanicErr("noedit/writeapidenied/blocked code returned, the bot may have been blocked. Dying")
+					case "pagedeleted":
+						log.Println("Page", title, "was deleted before we could get to it")
+						auditRules(title, revTS, rules, auditDeleted)
+					case "protectedpage":
+						log.Println("Page", title, "is protected; we detected", detectedBits)
+						auditRules(title, revTS, rules, auditProtected)
+						if !test {
+							notifyProtected(w, title, match.namespace, rules)
+						}
+					case "editconflict":
+						auditRules(title, revTS, rules, auditConflict)
+						if attempt < maxEditConflictRetries {
+							retryAfterConflict(w, title, regexes, test, attempt)
 							return
-						default:
-							log.Println("Error editing page", title, ". The error was", err)
 						}
+						// we've already tried three times, we've edit conflicted every time
+						// not worth it, just ignore the article for now; we'll come back later
+						return
 					default:
-						ybtools.PanicErr("Non-API error returned when trying to write to page ", title, " so dying. Error was ", err)
+						log.Println("Error editing page", title, ". The error was", err)
+						auditRules(title, revTS, rules, auditError)
 					}
+				default:
+					ybtools.PanicErr("Non-API error returned when trying to write to page ", title, " so dying. Error was ", err)
 				}
-			} else {
-				ybtools.PanicErr("Edit limited out, stopping")
 			}
+		} else {
+			ybtools.PanicErr("Edit limited out, stopping")
 		}
 	}
 }
 
-func tagIfNeeded(builder *strings.Builder, regex *regexp.Regexp, rsetup STRegex, text string, match []int) bool {
-	// ${n} returns the nth capture group, 1-indexed
-	// $$ returns a literal $
-	formatted := regex.ExpandString([]byte{}, rsetup.Prefix, text, match)
+// confirmConditions returns the rules in match whose conditions hold, checking those that
+// couldn't be checked when the page was matched. Finding out when a page was created takes
+// a request per page, so it's done here, one page at a time, and only for pages a rule with
+// an age condition has already matched. If we still can't find out, the rule is skipped.
+func confirmConditions(w *mwclient.Client, match articleMatch) (rules []ruleMatch) {
+	var page *fetchedPage
+	for _, rmatch := range match.rules {
+		if !rmatch.uncertain {
+			rules = append(rules, rmatch)
+			continue
+		}
+		if page == nil {
+			page = &fetchedPage{title: match.title, namespace: match.namespace, text: match.text,
+				revTS: match.revTS, curTS: match.curTS, created: creationFetcher(w, match.title)}
+		}
+		if holds, known := rmatch.rule.Conditions.eval(*page); holds && known {
+			rules = append(rules, rmatch)
+		} else {
+			audit(match.title, rmatch.rule.ID, match.revTS, auditConditions)
+		}
+	}
+	return
+}
+
+// settleGroups leaves only the first of rules in each group, as rules are in priority order.
+// matchArticle has already done this for rules it could be sure of, but a rule whose
+// conditions had to be confirmed might have been dropped since, leaving the next one through.
+func settleGroups(title, revTS string, rules []ruleMatch) (settled []ruleMatch) {
+	claimed := map[string]string{}
+	for _, rmatch := range rules {
+		group := rmatch.rule.Group
+		if by, ok := claimed[group]; ok && group != "" {
+			log.Println("Rule", rmatch.rule.ID, "matched", title, "but was superseded by", by, "in group", group)
+			audit(title, rmatch.rule.ID, revTS, auditSuperseded)
+			continue
+		}
+		claimed[group] = rmatch.rule.ID
+		settled = append(settled, rmatch)
+	}
+	return
+}
+
+// placedBlock is the tags from every rule with a given placement, one after another
+type placedBlock struct {
+	placement tagPlacement
+	tags      string
+}
+
+// placementBlocks groups the prefixes of placed by their placement, keeping them in order
+func placementBlocks(placed []ruleMatch) []placedBlock {
+	var blocks []placedBlock
+	index := map[string]int{}
+	for _, rmatch := range placed {
+		tag := rmatch.prefix
+		if !strings.HasSuffix(tag, "\n") {
+			tag += "\n"
+		}
+		key := rmatch.rule.Placement.String()
+		if i, ok := index[key]; ok {
+			blocks[i].tags += tag
+			continue
+		}
+		index[key] = len(blocks)
+		blocks = append(blocks, placedBlock{placement: rmatch.rule.Placement, tags: tag})
+	}
+	return blocks
+}
 
-	// make sure we don't tag an article more than once
-	if strings.Contains(text, string(formatted)) {
+// retryAfterConflict waits, backing off exponentially with each attempt, and then
+// fetches the latest revision of title and runs the rules over it from scratch.
+// Someone else has just edited the page, so they may well have already tagged it,
+// or changed it so that the rules no longer match at all.
+func retryAfterConflict(w *mwclient.Client, title string, regexes map[string]STRegex, test bool, attempt int8) {
+	backoff := editConflictBackoff << uint(attempt)
+	log.Println("Edit conflict on", title, "- retrying in", backoff)
+	time.Sleep(backoff)
+
+	pages, err := fetchPages(w, []string{title})
+	if err != nil {
+		log.Println("Failed to refetch", title, "after an edit conflict, so skipping it. Error was", err)
+		return
+	}
+	if len(pages) == 0 {
+		log.Println("Page", title, "was deleted before we could retry it")
+		return
+	}
+
+	editArticle(w, matchPage(pages[0], regexes, test, true), regexes, test, attempt+1)
+}
+
+// matchArticle runs each of the regexes over text, returning the rules that want to
+// add something to the article, and those that matched but were skipped.
+// Rules that page is out of scope for are left out altogether, unless test is true.
+// It doesn't check for nobots; that's up to the caller.
+func matchArticle(page fetchedPage, regexes map[string]STRegex, test bool) (matches []ruleMatch, skipped []ruleSkip) {
+	text := page.text
+	masker := newTextMasker(text)
+	page.masker = masker
+	optedOut := optedOutRules(text)
+	now := time.Now().UTC()
+	// the ID of the rule that has claimed each group, so that only one rule in a group applies
+	claimed := map[string]string{}
+	for _, rsetup := range sortedRules(regexes) {
+		if !test && (!rsetup.PageScope.inScope(page) || exclusions.excludesRule(page.title, rsetup.ID)) {
+			continue
+		}
+
+		regex := rsetup.Regex
+
+		// the masked text keeps the same offsets as text, so the match works on either
+		match := regex.FindStringSubmatchIndex(masker.mask(rsetup.MatchScope))
+		if match == nil {
+			continue
+		}
+
+		// respect editors who've opted this page out of the rule
+		if rsetup.optedOut(optedOut) {
+			skipped = append(skipped, ruleSkip{rule: rsetup, outcome: auditOptedOut})
+			continue
+		}
+
+		// check that the rest of the rule's conditions hold. If we can't know yet, as with a
+		// page's age, let it through; editArticle fetches what it needs and checks again
+		var uncertain bool
+		if rsetup.Conditions != nil {
+			holds, known := rsetup.Conditions.eval(page)
+			if known && !holds {
+				skipped = append(skipped, ruleSkip{rule: rsetup, outcome: auditConditions})
+				continue
+			}
+			uncertain = !known
+		}
+
+		// rules run in priority order, so a higher priority rule in the same group has already had its chance
+		if by, ok := claimed[rsetup.Group]; ok && rsetup.Group != "" {
+			log.Println("Rule", rsetup.ID, "matched", page.title, "but was superseded by", by, "in group", rsetup.Group)
+			skipped = append(skipped, ruleSkip{rule: rsetup, outcome: auditSuperseded})
+			continue
+		}
+
+		// make sure that there are no matches of NoTagIf
+		if rsetup.UseNTI && rsetup.NoTagIf.MatchString(text) {
+			// match found; ignore this regex. The page is probably already tagged by this
+			// rule, so the rest of its group shouldn't tag it either
+			claimed[rsetup.Group] = rsetup.ID
+			skipped = append(skipped, ruleSkip{rule: rsetup, outcome: auditNoTagIf})
+			continue
+		}
+
+		// and that the article has somewhere to put the prefix
+		if rsetup.Prefix != "" && !canPlace(text, rsetup.Placement) {
+			skipped = append(skipped, ruleSkip{rule: rsetup, outcome: auditNoPlacement})
+			continue
+		}
+
+		var articlePrepend strings.Builder
+		var articleAppend strings.Builder
+		var edited bool
+		variables := tagVariables(page.title, page.revTS, rsetup.ID, now)
+
+		if rsetup.Prefix != "" {
+			edited = tagIfNeeded(&articlePrepend, regex, rsetup.Prefix, text, match, variables)
+		}
+		if rsetup.Suffix != "" {
+			// set edited true if tagIfNeeded returns true; else, leave the previous value
+			edited = tagIfNeeded(&articleAppend, regex, rsetup.Suffix, text, match, variables) || edited
+		}
+
+		if edited {
+			// a rule whose conditions still have to be checked might not apply in the end, so
+			// it leaves the rest of its group to be settled by settleGroups once they have been
+			if !uncertain {
+				claimed[rsetup.Group] = rsetup.ID
+			}
+			matches = append(matches, ruleMatch{rule: rsetup, prefix: articlePrepend.String(), suffix: articleAppend.String(), uncertain: uncertain})
+		} else {
+			claimed[rsetup.Group] = rsetup.ID
+			skipped = append(skipped, ruleSkip{rule: rsetup, outcome: auditAlreadyTagged})
+		}
+	}
+
+	return
+}
+
+// tagIfNeeded expands template (a rule's prefix or suffix) using match and variables,
+// and writes it to builder unless the article already contains it. It returns whether it wrote anything.
+func tagIfNeeded(builder *strings.Builder, regex *regexp.Regexp, template string, text string, match []int, variables map[string]string) bool {
+	// make sure we don't tag an article more than once, even if it was tagged in a different month
+	if alreadyTagged(text, regex, template, match, variables) {
 		return false
 	}
 
+	// ${n} returns the nth capture group, 1-indexed
+	// ${name} returns a named capture group, or one of the built-in variables
+	// $$ returns a literal $
+	formatted := regex.ExpandString([]byte{}, expandVariables(template, regex, variables, false), text, match)
+
 	builder.Write(formatted)
 	return true
 }
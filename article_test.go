@@ -0,0 +1,188 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagIfNeeded(t *testing.T) {
+	tests := []struct {
+		name     string
+		regex    string
+		template string
+		text     string
+		want     string
+		wrote    bool
+	}{
+		{"plain template", `foo`, "{{Tag}}\n", "some foo text", "{{Tag}}\n", true},
+		{"capture group", `(\w+) is bad`, "{{Tag|${1}}}\n", "chocolate is bad", "{{Tag|chocolate}}\n", true},
+		{"multiple capture groups", `(\w+) and (\w+)`, "{{Tag|${2}|${1}}}", "salt and pepper", "{{Tag|pepper|salt}}", true},
+		{"escaped dollar", `price`, "{{Tag|cost=$$5}}", "the price", "{{Tag|cost=$5}}", true},
+		{"escaped dollar next to capture group", `(\d+) dollars`, "{{Tag|$$${1}}}", "5 dollars", "{{Tag|$5}}", true},
+		{"already tagged", `foo`, "{{Tag}}", "{{Tag}}\nsome foo text", "", false},
+		{"already tagged with capture group", `(\w+) is bad`, "{{Tag|${1}}}", "{{Tag|chocolate}} chocolate is bad", "", false},
+		{"different capture group isn't a duplicate", `(\w+) is bad`, "{{Tag|${1}}}", "{{Tag|cheese}} chocolate is bad", "{{Tag|chocolate}}", true},
+		{"date variable", `foo`, "{{Tag|date=${date}}}\n", "some foo text", "{{Tag|date=October 2026}}\n", true},
+		{"month and year variables", `foo`, "{{Tag|${month}|${year}}}", "some foo text", "{{Tag|October|2026}}", true},
+		{"title and rule variables", `foo`, "{{Tag|${title}|${rule}}}", "some foo text", "{{Tag|Some $5 page|foo}}", true},
+		{"revision timestamp variable", `foo`, "<!-- ${revtimestamp} -->", "some foo text", "<!-- 2026-10-01T12:00:00Z -->", true},
+		{"escaped variable", `foo`, "{{Tag|$${date}}}", "some foo text", "{{Tag|${date}}}", true},
+		{"named group beats variable", `(?P<date>\d+) foo`, "{{Tag|${date}}}", "12 foo", "{{Tag|12}}", true},
+		{"tagged in an earlier month", `foo`, "{{Tag|date=${date}}}", "{{Tag|date=May 2020}}\nsome foo text", "", false},
+		{"tagged with different parameters", `foo`, "{{Tag|date=${date}}}", "{{Tag|reason=x|date=May 2020}}\nsome foo text", "{{Tag|date=October 2026}}", true},
+	}
+	variables := tagVariables("Some_$5_page", "2026-10-01T12:00:00Z", "foo", time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			regex := regexp.MustCompile(test.regex)
+			var builder strings.Builder
+
+			wrote := tagIfNeeded(&builder, regex, test.template, test.text, regex.FindStringSubmatchIndex(test.text), variables)
+			if wrote != test.wrote {
+				t.Errorf("tagIfNeeded returned %v, want %v", wrote, test.wrote)
+			}
+			if builder.String() != test.want {
+				t.Errorf("tagIfNeeded wrote %q, want %q", builder.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestMatchArticlePrefixAndSuffix(t *testing.T) {
+	tests := []struct {
+		name       string
+		prefix     string
+		suffix     string
+		text       string
+		wantPrefix string
+		wantSuffix string
+		wantMatch  bool
+	}{
+		{"prefix only", "{{Top|${1}}}\n", "", "a (thing)", "{{Top|thing}}\n", "", true},
+		{"suffix only", "", "\n[[Category:${1}]]", "a (thing)", "", "\n[[Category:thing]]", true},
+		{"prefix and suffix", "{{Top}}\n", "\n{{Bottom|${1}}}", "a (thing)", "{{Top}}\n", "\n{{Bottom|thing}}", true},
+		{"suffix already there", "{{Top}}\n", "\n{{Bottom}}", "a (thing)\n{{Bottom}}", "{{Top}}\n", "", true},
+		{"both already there", "{{Top}}\n", "\n{{Bottom}}", "{{Top}}\na (thing)\n{{Bottom}}", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := STRegex{ID: "thing", Key: `\((\w+)\)`, Regex: regexp.MustCompile(`\((\w+)\)`), Prefix: test.prefix, Suffix: test.suffix, Detected: "a thing"}
+
+			matches, skipped := matchArticle(fetchedPage{title: "Test", text: test.text}, map[string]STRegex{rule.ID: rule}, false)
+			if !test.wantMatch {
+				if len(matches) != 0 {
+					t.Fatalf("matchArticle matched when it shouldn't have: %+v", matches)
+				}
+				if len(skipped) != 1 || skipped[0].outcome != auditAlreadyTagged {
+					t.Errorf("matchArticle skipped %+v, want one already tagged skip", skipped)
+				}
+				return
+			}
+
+			if len(matches) != 1 {
+				t.Fatalf("matchArticle returned %d matches, want 1", len(matches))
+			}
+			if matches[0].prefix != test.wantPrefix {
+				t.Errorf("prefix was %q, want %q", matches[0].prefix, test.wantPrefix)
+			}
+			if matches[0].suffix != test.wantSuffix {
+				t.Errorf("suffix was %q, want %q", matches[0].suffix, test.wantSuffix)
+			}
+		})
+	}
+}
+
+func TestMatchArticleOrder(t *testing.T) {
+	regexes := map[string]STRegex{
+		"refimprove":  {ID: "refimprove", Regex: regexp.MustCompile(`claim`), Prefix: "{{More citations needed}}\n", Detected: "a claim"},
+		"unsourced":   {ID: "unsourced", Regex: regexp.MustCompile(`claim`), Prefix: "{{Unreferenced}}\n", Detected: "an unsourced claim", Priority: 1},
+		"advert":      {ID: "advert", Regex: regexp.MustCompile(`claim`), Prefix: "{{Advert}}\n", Detected: "an advert"},
+		"lowpriority": {ID: "lowpriority", Regex: regexp.MustCompile(`claim`), Prefix: "{{Low}}\n", Detected: "something minor", Priority: -1},
+	}
+
+	// run it a few times, as map iteration order changes from one run to the next
+	for i := 0; i < 10; i++ {
+		matches, _ := matchArticle(fetchedPage{title: "Test", text: "A claim."}, regexes, false)
+		var got []string
+		for _, rmatch := range matches {
+			got = append(got, rmatch.rule.ID)
+		}
+		if want := "unsourced advert refimprove lowpriority"; strings.Join(got, " ") != want {
+			t.Fatalf("matchArticle matched %v, want %s", got, want)
+		}
+	}
+}
+
+func TestMatchArticleGroups(t *testing.T) {
+	regexes := map[string]STRegex{
+		"unsourced": {ID: "unsourced", Regex: regexp.MustCompile(`claim`), Prefix: "{{Unreferenced}}\n", Detected: "an unsourced claim",
+			NoTagIf: regexp.MustCompile(`\{\{Unreferenced`), UseNTI: true, Priority: 1, Group: "refs"},
+		"refimprove": {ID: "refimprove", Regex: regexp.MustCompile(`claim`), Prefix: "{{More citations needed}}\n", Detected: "a claim", Group: "refs"},
+		"advert":     {ID: "advert", Regex: regexp.MustCompile(`claim`), Prefix: "{{Advert}}\n", Detected: "an advert"},
+	}
+
+	tests := []struct {
+		name        string
+		text        string
+		wantMatches string
+		wantSkipped string
+	}{
+		{"highest priority wins", "A claim.", "unsourced advert", "refimprove:skipped-superseded"},
+		{"already tagged by the winner", "{{Unreferenced}}\nA claim.", "advert", "unsourced:skipped-notagif refimprove:skipped-superseded"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, skipped := matchArticle(fetchedPage{title: "Test", text: test.text}, regexes, false)
+			var gotMatches, gotSkipped []string
+			for _, rmatch := range matches {
+				gotMatches = append(gotMatches, rmatch.rule.ID)
+			}
+			for _, skip := range skipped {
+				gotSkipped = append(gotSkipped, skip.rule.ID+":"+skip.outcome)
+			}
+			if strings.Join(gotMatches, " ") != test.wantMatches || strings.Join(gotSkipped, " ") != test.wantSkipped {
+				t.Errorf("matchArticle matched %v and skipped %v, want %s and %s", gotMatches, gotSkipped, test.wantMatches, test.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestSettleGroups(t *testing.T) {
+	rules := []ruleMatch{
+		{rule: STRegex{ID: "newclaim", Group: "refs"}, uncertain: true},
+		{rule: STRegex{ID: "advert"}},
+		{rule: STRegex{ID: "unsourced", Group: "refs"}},
+		{rule: STRegex{ID: "peacock"}},
+	}
+
+	var got []string
+	for _, rmatch := range settleGroups("Test", "", rules) {
+		got = append(got, rmatch.rule.ID)
+	}
+	if want := "newclaim advert peacock"; strings.Join(got, " ") != want {
+		t.Errorf("settleGroups left %v, want %s", got, want)
+	}
+}
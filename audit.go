@@ -0,0 +1,103 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// These are the outcomes recorded in the audit log
+const (
+	auditMatched       string = "matched"
+	auditNoTagIf       string = "skipped-notagif"
+	auditAlreadyTagged string = "skipped-alreadytagged"
+	auditNobots        string = "skipped-nobots"
+	auditCapped        string = "skipped-capped"
+	auditNoPlacement   string = "skipped-noplacement"
+	auditConditions    string = "skipped-conditions"
+	auditOptedOut      string = "skipped-optout"
+	auditSuperseded    string = "skipped-superseded"
+	auditDryRun        string = "dryrun"
+	auditEdited        string = "edited"
+	auditConflict      string = "editconflict"
+	auditProtected     string = "protected"
+	auditDeleted       string = "deleted"
+	auditError         string = "error"
+)
+
+// auditEntry is a single line of the audit log
+type auditEntry struct {
+	Time         string `json:"time"`
+	Title        string `json:"title"`
+	Rule         string `json:"rule,omitempty"`
+	RevTimestamp string `json:"revTimestamp,omitempty"`
+	Outcome      string `json:"outcome"`
+}
+
+// Matching happens on lots of goroutines at once, so the audit log has to be locked
+var auditMutex sync.Mutex
+var auditEncoder *json.Encoder
+
+// audit writes a line to the audit log, if there is one. rule can be empty, if
+// the outcome applies to the whole page rather than to a specific rule.
+// It's called from the matching goroutines, so failures are logged and counted
+// rather than stopping the bot from there.
+func audit(title, rule, revTS, outcome string) {
+	if config.AuditLogPath == "" {
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if auditEncoder == nil {
+		file, err := os.OpenFile(config.AuditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Println("Failed to open audit log with error", err)
+			metrics.auditError()
+			return
+		}
+		// the file is only closed when we exit, but as it's append-only
+		// and we don't buffer, every line will already have been written
+		auditEncoder = json.NewEncoder(file)
+	}
+
+	err := auditEncoder.Encode(auditEntry{
+		Time:         time.Now().UTC().Format(time.RFC3339),
+		Title:        title,
+		Rule:         rule,
+		RevTimestamp: revTS,
+		Outcome:      outcome,
+	})
+	if err != nil {
+		log.Println("Failed to write to audit log with error", err)
+		metrics.auditError()
+	}
+}
+
+// auditRules writes the same outcome to the audit log for each rule in rules
+func auditRules(title, revTS string, rules []ruleMatch, outcome string) {
+	for _, rmatch := range rules {
+		audit(title, rmatch.rule.ID, revTS, outcome)
+	}
+}
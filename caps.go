@@ -0,0 +1,119 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+const defaultRuleCountsPath string = "scantag.rulecounts"
+
+// ruleEditCounts keeps track of how many edits each rule has made, so that
+// maxEditsPerDay and maxEditsPerRun can be enforced. It's saved to disk after
+// every edit, so the caps still hold if the bot is restarted.
+type ruleEditCounts struct {
+	// Day is the UTC date that Today refers to
+	Day     string
+	Today   map[string]int64
+	ThisRun map[string]int64
+}
+
+// nil until it's first needed, at which point it's loaded from disk
+var ruleCounts *ruleEditCounts
+
+func ruleCountsPath() string {
+	if config.RuleCountsPath == "" {
+		return defaultRuleCountsPath
+	}
+	return config.RuleCountsPath
+}
+
+// loadRuleCounts makes sure ruleCounts is loaded, and that its daily counts are for today
+func loadRuleCounts() {
+	if ruleCounts == nil {
+		ruleCounts = &ruleEditCounts{}
+		countsJSON, err := ioutil.ReadFile(ruleCountsPath())
+		if err == nil {
+			if err := json.Unmarshal(countsJSON, ruleCounts); err != nil {
+				ybtools.PanicErr("Rule counts file is corrupt with error ", err)
+			}
+		}
+		if ruleCounts.ThisRun == nil {
+			ruleCounts.ThisRun = map[string]int64{}
+		}
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	if ruleCounts.Day != today || ruleCounts.Today == nil {
+		ruleCounts.Day = today
+		ruleCounts.Today = map[string]int64{}
+	}
+}
+
+func saveRuleCounts() {
+	countsJSON, err := json.Marshal(ruleCounts)
+	if err != nil {
+		ybtools.PanicErr("Failed to serialise rule counts with error ", err)
+	}
+	if err := writeFileAtomic(ruleCountsPath(), countsJSON); err != nil {
+		ybtools.PanicErr("Failed to write rule counts with error ", err)
+	}
+}
+
+// startRun resets the per-run edit counts; it's called whenever a new run starts from scratch
+func startRun() {
+	loadRuleCounts()
+	ruleCounts.ThisRun = map[string]int64{}
+	saveRuleCounts()
+}
+
+// uncappedRules returns the rules from matches on title that haven't yet hit their edit caps
+func uncappedRules(title, revTS string, matches []ruleMatch) (uncapped []ruleMatch) {
+	loadRuleCounts()
+	for _, rmatch := range matches {
+		rule := rmatch.rule
+		if rule.MaxEditsPerDay > 0 && ruleCounts.Today[rule.ID] >= rule.MaxEditsPerDay {
+			log.Println("Rule", rule.ID, "has hit its daily edit cap, not applying it")
+			audit(title, rule.ID, revTS, auditCapped)
+			continue
+		}
+		if rule.MaxEditsPerRun > 0 && ruleCounts.ThisRun[rule.ID] >= rule.MaxEditsPerRun {
+			log.Println("Rule", rule.ID, "has hit its per-run edit cap, not applying it")
+			audit(title, rule.ID, revTS, auditCapped)
+			continue
+		}
+		uncapped = append(uncapped, rmatch)
+	}
+	return
+}
+
+// recordRuleEdits counts an edit against each of the rules in matches
+func recordRuleEdits(matches []ruleMatch) {
+	loadRuleCounts()
+	for _, rmatch := range matches {
+		ruleCounts.Today[rmatch.rule.ID]++
+		ruleCounts.ThisRun[rmatch.rule.ID]++
+	}
+	saveRuleCounts()
+}
@@ -0,0 +1,107 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessBatchRunCap(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	config.RegexesJSONPageID = strconv.Itoa(fw.setPage("User:Yapperbot/Scantag.json", `{
+		"unsourced claim": {
+			"id": "unsourced",
+			"detected": "an unsourced claim",
+			"noTagIf": "\\{\\{unreferenced",
+			"prefix": "{{Unreferenced}}\n",
+			"maxEditsPerRun": 1
+		},
+		"\\(stub\\)": {
+			"id": "stub",
+			"detected": "a stub marker",
+			"noTagIf": false,
+			"suffix": "\n{{stub}}"
+		}
+	}`))
+	loadRegexes(w)
+
+	for _, title := range []string{"First", "Second", "Third", "Fourth"} {
+		fw.setPage(title, "An unsourced claim (stub)")
+	}
+	tagged := func(title string) (unsourced, stub bool) {
+		text := fw.text(title)
+		return strings.Contains(text, "{{Unreferenced}}"), strings.Contains(text, "{{stub}}")
+	}
+
+	var processed uint64
+	processBatch(w, []string{"First", "Second"}, &processed)
+	if unsourced, stub := tagged("First"); !unsourced || !stub {
+		t.Errorf("First page should have been tagged by both rules:\n%s", fw.text("First"))
+	}
+	// the capped rule is left out, but the other rule on the page still applies
+	if unsourced, stub := tagged("Second"); unsourced || !stub {
+		t.Errorf("Second page should only have been tagged by the uncapped rule:\n%s", fw.text("Second"))
+	}
+
+	// the counts are saved, so the cap still holds after a restart
+	ruleCounts = nil
+	processBatch(w, []string{"Third"}, &processed)
+	if unsourced, _ := tagged("Third"); unsourced {
+		t.Errorf("Per-run cap didn't hold after reloading the counts:\n%s", fw.text("Third"))
+	}
+
+	// but a new run starts the count again
+	startRun()
+	processBatch(w, []string{"Fourth"}, &processed)
+	if unsourced, _ := tagged("Fourth"); !unsourced {
+		t.Errorf("Per-run cap wasn't reset by a new run:\n%s", fw.text("Fourth"))
+	}
+}
+
+func TestRuleCountsDailyRollover(t *testing.T) {
+	setupFlowTest(t)
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	countsJSON, _ := json.Marshal(ruleEditCounts{
+		Day:     yesterday,
+		Today:   map[string]int64{"unsourced": 5},
+		ThisRun: map[string]int64{"unsourced": 7},
+	})
+	if err := ioutil.WriteFile(config.RuleCountsPath, countsJSON, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := STRegex{ID: "unsourced", MaxEditsPerDay: 5, MaxEditsPerRun: 10}
+	if uncapped := uncappedRules("Test", "", []ruleMatch{{rule: rule}}); len(uncapped) != 1 {
+		t.Error("Yesterday's edits still counted towards today's cap")
+	}
+	if ruleCounts.Today["unsourced"] != 0 || ruleCounts.ThisRun["unsourced"] != 7 {
+		t.Errorf("Rolling over to a new day gave %+v, want only the daily counts reset", ruleCounts)
+	}
+
+	recordRuleEdits([]ruleMatch{{rule: rule}, {rule: rule}, {rule: rule}, {rule: rule}, {rule: rule}})
+	if uncapped := uncappedRules("Test", "", []ruleMatch{{rule: rule}}); len(uncapped) != 0 {
+		t.Error("Daily cap wasn't enforced after the rule's edits were recorded")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+const defaultCheckpointPath string = "scantag.checkpoint"
+
+// checkpoint records how far through a titles file we've got, so that a run
+// can be resumed after a crash or restart rather than starting from the top.
+type checkpoint struct {
+	// Path is the titles file that the checkpoint refers to
+	Path string
+	// Offset is the number of titles that have been fully processed
+	Offset uint64
+	// RulesHash is the hash of the rule set in use when the checkpoint was saved
+	RulesHash string
+}
+
+func checkpointPath() string {
+	if config.CheckpointPath == "" {
+		return defaultCheckpointPath
+	}
+	return config.CheckpointPath
+}
+
+// resumeOffset returns the number of titles in path that can be skipped, based on the
+// saved checkpoint. If we're not resuming, there's no checkpoint for path, or the
+// rules have changed since the checkpoint was saved, it returns zero.
+func resumeOffset(path, rulesHash string) uint64 {
+	if !resume {
+		return 0
+	}
+
+	checkpointJSON, err := ioutil.ReadFile(checkpointPath())
+	if err != nil {
+		log.Println("No checkpoint to resume from, starting from the beginning")
+		return 0
+	}
+
+	var saved checkpoint
+	if err := json.Unmarshal(checkpointJSON, &saved); err != nil {
+		log.Println("Checkpoint file is corrupt, starting from the beginning. Error was", err)
+		return 0
+	}
+
+	if saved.Path != path {
+		log.Println("Checkpoint is for", saved.Path, "rather than", path, "so starting from the beginning")
+		return 0
+	}
+	if saved.RulesHash != rulesHash {
+		log.Println("Rules have changed since the checkpoint was saved, so starting from the beginning")
+		return 0
+	}
+
+	log.Println("Resuming", path, "from title", saved.Offset)
+	return saved.Offset
+}
+
+// saveCheckpoint records that the first offset titles of path have been processed
+func saveCheckpoint(path string, offset uint64, rulesHash string) {
+	checkpointJSON, err := json.Marshal(checkpoint{Path: path, Offset: offset, RulesHash: rulesHash})
+	if err != nil {
+		ybtools.PanicErr("Failed to serialise checkpoint with error ", err)
+	}
+	if err := writeFileAtomic(checkpointPath(), checkpointJSON); err != nil {
+		ybtools.PanicErr("Failed to write checkpoint with error ", err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and moves it into place at path,
+// so that dying halfway through a write can't leave path corrupt
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// clearCheckpoint removes the checkpoint once a titles file has been fully processed
+func clearCheckpoint() {
+	if err := os.Remove(checkpointPath()); err != nil && !os.IsNotExist(err) {
+		ybtools.PanicErr("Failed to remove checkpoint with error ", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupCheckpointTest points the checkpoint at a temporary file, with resuming turned on
+func setupCheckpointTest(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("", "scantag-checkpoint")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	oldPath, oldResume := config.CheckpointPath, resume
+	t.Cleanup(func() {
+		config.CheckpointPath, resume = oldPath, oldResume
+		os.RemoveAll(tmpDir)
+	})
+	config.CheckpointPath = filepath.Join(tmpDir, "checkpoint")
+	resume = true
+	return tmpDir
+}
+
+func TestResumeOffset(t *testing.T) {
+	tests := []struct {
+		name      string
+		saved     bool
+		resume    bool
+		corrupt   bool
+		path      string
+		rulesHash string
+		want      uint64
+	}{
+		{"resumes", true, true, false, "titles.gz", "abc", 1500},
+		{"not resuming", true, false, false, "titles.gz", "abc", 0},
+		{"no checkpoint", false, true, false, "titles.gz", "abc", 0},
+		{"corrupt checkpoint", true, true, true, "titles.gz", "abc", 0},
+		{"different titles file", true, true, false, "candidates.gz", "abc", 0},
+		{"rules changed", true, true, false, "titles.gz", "def", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupCheckpointTest(t)
+			if test.saved {
+				saveCheckpoint("titles.gz", 1500, "abc")
+			}
+			if test.corrupt {
+				if err := ioutil.WriteFile(config.CheckpointPath, []byte("{not json"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			resume = test.resume
+
+			if got := resumeOffset(test.path, test.rulesHash); got != test.want {
+				t.Errorf("resumeOffset gave %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProcessTitlesFileResumes(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	tmpDir := setupCheckpointTest(t)
+
+	titles := []string{"Done one", "Done two", "To do one", "To do two"}
+	for _, title := range titles {
+		fw.setPage(title, "This is an unsourced claim.")
+	}
+
+	path := filepath.Join(tmpDir, "titles.gz")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(file)
+	gz.Write([]byte("page_title\n" + strings.ReplaceAll(strings.Join(titles, "\n"), " ", "_") + "\n"))
+	gz.Close()
+	file.Close()
+
+	// a restart part way through, after the first two titles
+	saveCheckpoint(path, 2, "hash")
+	processTitlesFile(w, path, "hash")
+
+	for i, title := range titles {
+		tagged := strings.HasPrefix(fw.text(title), "{{Unreferenced")
+		if tagged != (i >= 2) {
+			t.Errorf("%s was tagged: %v, but should only have been tagged if it was after the checkpoint", title, tagged)
+		}
+	}
+	if _, err := os.Stat(config.CheckpointPath); !os.IsNotExist(err) {
+		t.Error("Checkpoint wasn't cleared after the whole file was processed")
+	}
+}
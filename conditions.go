@@ -0,0 +1,228 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/antonholmquist/jason"
+)
+
+// condition is a node in a rule's condition tree, which has to hold for the rule to apply
+type condition interface {
+	// eval returns whether the condition holds, or known = false if there isn't
+	// enough information about the page to say either way
+	eval(page fetchedPage) (holds bool, known bool)
+	// String describes the condition for the sandbox
+	String() string
+}
+
+type allCondition []condition
+type anyCondition []condition
+type notCondition struct{ condition }
+
+// regexCondition holds if its regex matches anywhere in the article
+type regexCondition struct {
+	regex *regexp.Regexp
+	raw   string
+}
+
+// measureCondition holds if a measure of the article is at least (or at most) limit
+type measureCondition struct {
+	measure string
+	max     bool
+	limit   int64
+}
+
+// measures are the things about an article that min and max predicates can look at,
+// keyed by the name that goes after "min" or "max" in the JSON. They're defined in metadata.go.
+var measures = map[string]struct {
+	describe string
+	measure  func(page fetchedPage) (value int64, known bool)
+}{
+	"Bytes":         {"bytes", pageBytes},
+	"Words":         {"words of prose", pageWords},
+	"Refs":          {"references", pageRefs},
+	"Links":         {"links", pageLinks},
+	"Sections":      {"sections", pageSections},
+	"AgeDays":       {"days since the page was created", pageAgeDays},
+	"DaysSinceEdit": {"days since the last edit", pageDaysSinceEdit},
+}
+
+// all and any follow three-valued logic, so a condition that can't be known
+// only makes the result unknown if it could have changed it
+func (c allCondition) eval(page fetchedPage) (holds bool, known bool) {
+	known = true
+	for _, child := range c {
+		childHolds, childKnown := child.eval(page)
+		if childKnown && !childHolds {
+			return false, true
+		}
+		known = known && childKnown
+	}
+	return true, known
+}
+
+func (c anyCondition) eval(page fetchedPage) (holds bool, known bool) {
+	known = true
+	for _, child := range c {
+		childHolds, childKnown := child.eval(page)
+		if childKnown && childHolds {
+			return true, true
+		}
+		known = known && childKnown
+	}
+	return false, known
+}
+
+func (c notCondition) eval(page fetchedPage) (holds bool, known bool) {
+	holds, known = c.condition.eval(page)
+	return !holds, known
+}
+
+func (c regexCondition) eval(page fetchedPage) (holds bool, known bool) {
+	return c.regex.MatchString(page.text), true
+}
+
+func (c measureCondition) eval(page fetchedPage) (holds bool, known bool) {
+	value, known := measures[c.measure].measure(page)
+	if !known {
+		return false, false
+	}
+	if c.max {
+		return value <= c.limit, true
+	}
+	return value >= c.limit, true
+}
+
+func (c allCondition) String() string { return joinConditions(c, " AND ") }
+func (c anyCondition) String() string { return joinConditions(c, " OR ") }
+func (c notCondition) String() string { return "NOT " + nestedCondition(c.condition) }
+func (c regexCondition) String() string {
+	return "matches /" + c.raw + "/"
+}
+func (c measureCondition) String() string {
+	if c.max {
+		return fmt.Sprintf("at most %d %s", c.limit, measures[c.measure].describe)
+	}
+	return fmt.Sprintf("at least %d %s", c.limit, measures[c.measure].describe)
+}
+
+func joinConditions(conditions []condition, operator string) string {
+	var parts []string
+	for _, child := range conditions {
+		parts = append(parts, nestedCondition(child))
+	}
+	return strings.Join(parts, operator)
+}
+
+// nestedCondition describes a condition inside another, bracketing it if it's compound
+func nestedCondition(c condition) string {
+	switch c.(type) {
+	case allCondition, anyCondition:
+		return "(" + c.String() + ")"
+	}
+	return c.String()
+}
+
+// parseCondition compiles a condition tree from a rule's JSON. Each node is either
+// a string, which is shorthand for a regex, or an object with exactly one of the keys
+// all, any, not, regex, or a min or max predicate such as minBytes.
+func parseCondition(value *jason.Value) (condition, error) {
+	if regex, err := value.String(); err == nil {
+		return parseRegexCondition(regex)
+	}
+
+	object, err := value.Object()
+	if err != nil {
+		return nil, fmt.Errorf("conditions must be strings or objects")
+	}
+	fields := object.Map()
+	if len(fields) != 1 {
+		return nil, fmt.Errorf("condition objects must have exactly one key, but one had %d", len(fields))
+	}
+
+	for key, child := range fields {
+		switch key {
+		case "all", "any":
+			children, err := child.Array()
+			if err != nil || len(children) == 0 {
+				return nil, fmt.Errorf("%s must be a non-empty array of conditions", key)
+			}
+			var compiled []condition
+			for _, grandchild := range children {
+				c, err := parseCondition(grandchild)
+				if err != nil {
+					return nil, err
+				}
+				compiled = append(compiled, c)
+			}
+			if key == "all" {
+				return allCondition(compiled), nil
+			}
+			return anyCondition(compiled), nil
+		case "not":
+			c, err := parseCondition(child)
+			if err != nil {
+				return nil, err
+			}
+			return notCondition{c}, nil
+		case "regex":
+			regex, err := child.String()
+			if err != nil {
+				return nil, fmt.Errorf("regex must be a string")
+			}
+			return parseRegexCondition(regex)
+		default:
+			return parseMeasureCondition(key, child)
+		}
+	}
+	// unreachable, as there's exactly one field
+	return nil, nil
+}
+
+func parseRegexCondition(regex string) (condition, error) {
+	compiled, err := regexp.Compile("(?i)" + regex)
+	if err != nil {
+		return nil, fmt.Errorf("condition regex `%s` is invalid: %s", regex, err)
+	}
+	return regexCondition{regex: compiled, raw: regex}, nil
+}
+
+func parseMeasureCondition(key string, value *jason.Value) (condition, error) {
+	var c measureCondition
+	switch {
+	case strings.HasPrefix(key, "min"):
+		c.measure = strings.TrimPrefix(key, "min")
+	case strings.HasPrefix(key, "max"):
+		c.measure, c.max = strings.TrimPrefix(key, "max"), true
+	}
+	if _, ok := measures[c.measure]; !ok {
+		return nil, fmt.Errorf("unknown condition `%s`", key)
+	}
+
+	limit, err := value.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a whole number", key)
+	}
+	c.limit = limit
+	return c, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"testing"
+
+	"github.com/antonholmquist/jason"
+)
+
+func mustParseCondition(t *testing.T, conditionJSON string) condition {
+	value, err := jason.NewValueFromBytes([]byte(conditionJSON))
+	if err != nil {
+		t.Fatal("Bad test condition:", err)
+	}
+	c, err := parseCondition(value)
+	if err != nil {
+		t.Fatal("parseCondition failed:", err)
+	}
+	return c
+}
+
+func TestConditions(t *testing.T) {
+	const unreferenced = `{"all": [{"not": "<ref"}, {"not": {"regex": "\\{\\{sfn"}}, {"minBytes": 20}]}`
+	tests := []struct {
+		name      string
+		condition string
+		text      string
+		want      bool
+	}{
+		{"regex shorthand", `"foo"`, "some FOO", true},
+		{"regex", `{"regex": "foo"}`, "bar", false},
+		{"all holds", unreferenced, "A long enough article with no references.", true},
+		{"all fails on ref", unreferenced, "A long enough article.<ref>Source</ref>", false},
+		{"all fails on sfn", unreferenced, "A long enough article.{{sfn|Smith|2020}}", false},
+		{"all fails on length", unreferenced, "Short.", false},
+		{"any", `{"any": ["foo", "bar"]}`, "bar", true},
+		{"any fails", `{"any": ["foo", "bar"]}`, "baz", false},
+		{"max bytes", `{"maxBytes": 5}`, "12345", true},
+		{"max bytes fails", `{"maxBytes": 5}`, "123456", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := mustParseCondition(t, test.condition)
+			if got, _ := c.eval(fetchedPage{text: test.text}); got != test.want {
+				t.Errorf("%s gave %v on %q, want %v", c, got, test.text, test.want)
+			}
+		})
+	}
+}
+
+func TestConditionString(t *testing.T) {
+	c := mustParseCondition(t, `{"all": [{"not": "<ref"}, {"any": [{"minBytes": 2000}, {"not": {"any": ["a", "b"]}}]}]}`)
+	want := "NOT matches /<ref/ AND (at least 2000 bytes OR NOT (matches /a/ OR matches /b/))"
+	if got := c.String(); got != want {
+		t.Errorf("String gave %q, want %q", got, want)
+	}
+}
+
+func TestParseConditionInvalid(t *testing.T) {
+	for _, condition := range []string{`5`, `{}`, `{"all": []}`, `{"not": "("}`, `{"minWidgets": 5}`, `{"minBytes": "lots"}`, `{"regex": "a", "not": "b"}`} {
+		value, _ := jason.NewValueFromBytes([]byte(condition))
+		if _, err := parseCondition(value); err == nil {
+			t.Errorf("parseCondition accepted %s", condition)
+		}
+	}
+}
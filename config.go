@@ -21,8 +21,23 @@ package main
 // Config stores relevant configuration information, and is retrieved from a
 // YAML file by ybtools.
 type Config struct {
-	RegexesJSONPageID string
-	SandboxJSONPageID string
-	SandboxPageID     string
-	PathToArticles    string
+	RegexesJSONPageID      string
+	SandboxJSONPageID      string
+	SandboxPageID          string
+	PathToArticles         string
+	DryRunReportPath       string
+	PathToDump             string
+	PathToCandidates       string
+	MatchWorkers           int
+	CheckpointPath         string
+	RecentChangesStatePath string
+	RecentChangesInterval  int
+	RuleCountsPath         string
+	AuditLogPath           string
+	MetricsListen          string
+	ProtectedNotify        string
+	ProtectedReportPageID  string
+	ExclusionsJSONPageID   string
+	// Zero means we never create a {{Multiple issues}} wrapper, only add to existing ones
+	MultipleIssuesThreshold int
 }
@@ -0,0 +1,102 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	// the expected output is what diff -u gives for the same texts
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{"both empty",
+			"",
+			"",
+			""},
+		{"no changes",
+			"a\nb\n",
+			"a\nb\n",
+			""},
+		{"from empty",
+			"",
+			"x\n",
+			"--- a/T\n+++ b/T\n@@ -0,0 +1 @@\n+x\n"},
+		{"to empty",
+			"x\ny\n",
+			"",
+			"--- a/T\n+++ b/T\n@@ -1,2 +0,0 @@\n-x\n-y\n"},
+		{"insert only",
+			"l1\nl2\nl3\nl4\nl5\nl6\nl7\nl8\nl9\nl10\n",
+			"l1\nl2\nl3\nl4\nl5\nnew\nl6\nl7\nl8\nl9\nl10\n",
+			"--- a/T\n+++ b/T\n@@ -3,6 +3,7 @@\n l3\n l4\n l5\n+new\n l6\n l7\n l8\n"},
+		{"delete only",
+			"l1\nl2\nl3\nl4\nl5\nl6\nl7\nl8\nl9\nl10\n",
+			"l1\nl2\nl3\nl5\nl6\nl7\nl8\nl9\nl10\n",
+			"--- a/T\n+++ b/T\n@@ -1,7 +1,6 @@\n l1\n l2\n l3\n-l4\n l5\n l6\n l7\n"},
+		{"nearby changes share a hunk",
+			"l1\nl2\nl3\nl4\nl5\nl6\nl7\nl8\nl9\nl10\nl11\nl12\n",
+			"l1\nl2\nL3\nl4\nl5\nl6\nl7\nL8\nl9\nl10\nl11\nl12\n",
+			"--- a/T\n+++ b/T\n@@ -1,11 +1,11 @@\n l1\n l2\n-l3\n+L3\n l4\n l5\n l6\n l7\n-l8\n+L8\n l9\n l10\n l11\n"},
+		{"distant changes get their own hunks",
+			"l1\nl2\nl3\nl4\nl5\nl6\nl7\nl8\nl9\nl10\nl11\nl12\nl13\nl14\nl15\nl16\nl17\nl18\nl19\nl20\n",
+			"l1\nL2\nl3\nl4\nl5\nl6\nl7\nl8\nl9\nl10\nl11\nl12\nl13\nl14\nl15\nl16\nl17\nL18\nl19\nl20\n",
+			"--- a/T\n+++ b/T\n@@ -1,5 +1,5 @@\n l1\n-l2\n+L2\n l3\n l4\n l5\n@@ -15,6 +15,6 @@\n l15\n l16\n l17\n-l18\n+L18\n l19\n l20\n"},
+		{"newline added at the end",
+			"a\nx",
+			"a\nx\n",
+			"--- a/T\n+++ b/T\n@@ -1,2 +1,2 @@\n a\n-x\n\\ No newline at end of file\n+x\n"},
+		{"newline removed from the end",
+			"a\nx\n",
+			"a\nx",
+			"--- a/T\n+++ b/T\n@@ -1,2 +1,2 @@\n a\n-x\n+x\n\\ No newline at end of file\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := unifiedDiff("a/T", "b/T", test.a, test.b); got != test.want {
+				t.Errorf("unifiedDiff gave:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDryRunFilename(t *testing.T) {
+	if got := dryRunFilename("Foo/bar baz"); got != "Foo%2Fbar_baz.diff" {
+		t.Errorf("dryRunFilename gave %s for a short title", got)
+	}
+
+	long := strings.Repeat("Ж", 60)
+	got := dryRunFilename(long)
+	if len(got) > 255 {
+		t.Errorf("dryRunFilename gave a %d byte file name for a long title", len(got))
+	}
+	if other := dryRunFilename(long + "Ж"); other == got {
+		t.Error("dryRunFilename gave the same file name for two different long titles")
+	}
+	if _, err := url.PathUnescape(got); err != nil {
+		t.Errorf("dryRunFilename cut an escape sequence in half: %s", got)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+const defaultDryRunReportPath string = "dryrun"
+
+// The longest a report's file name can be before it's shortened; most filesystems
+// allow 255 bytes, and escaping non-ASCII titles can triple their length
+const dryRunMaxFilenameLength int = 200
+
+// dryRunReportPath returns the directory that dry run reports should be written to,
+// making sure that it exists first.
+func dryRunReportPath() string {
+	path := config.DryRunReportPath
+	if path == "" {
+		path = defaultDryRunReportPath
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		ybtools.PanicErr("Failed to create dry run report directory with error ", err)
+	}
+	return path
+}
+
+// writeDryRunReport writes a diff of the edit we would have made to title into the
+// dry run report directory, alongside the summary and the rules that were detected.
+func writeDryRunReport(title, oldText, newText, summary string, detected []string) {
+	var report strings.Builder
+	report.WriteString("Title: " + title + "\n")
+	report.WriteString("Summary: " + summary + "\n")
+	for _, rule := range detected {
+		report.WriteString("Detected: " + rule + "\n")
+	}
+	report.WriteString("\n")
+	report.WriteString(unifiedDiff("a/"+title, "b/"+title, oldText, newText))
+
+	err := ioutil.WriteFile(filepath.Join(dryRunReportPath(), dryRunFilename(title)), []byte(report.String()), 0644)
+	if err != nil {
+		// one page's report isn't worth stopping the rest of the dry run for
+		log.Println("Failed to write dry run report for", title, "with error", err)
+		return
+	}
+	log.Println("Dry run: would have edited", title, "with", strings.Join(detected, "; "))
+}
+
+// dryRunFilename returns the name of the report file for title. Titles can contain slashes,
+// so they're escaped to keep one file per title; long ones are cut short, with a hash of
+// the whole title on the end to keep them apart.
+func dryRunFilename(title string) string {
+	escaped := url.PathEscape(strings.ReplaceAll(title, " ", "_"))
+	if len(escaped) <= dryRunMaxFilenameLength {
+		return escaped + ".diff"
+	}
+
+	cut := dryRunMaxFilenameLength - 13
+	// don't leave half an escape sequence at the end
+	if i := strings.LastIndexByte(escaped[:cut], '%'); i > cut-3 {
+		cut = i
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(title)))[:12]
+	return escaped[:cut] + "-" + hash + ".diff"
+}
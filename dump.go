@@ -0,0 +1,238 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+const defaultCandidatesPath string = "candidates.gz"
+
+// How often to log progress when scanning through a dump
+const dumpProgressInterval uint64 = 100000
+
+// dumpPage is a single <page> element from a pages-articles XML dump.
+// Only the parts we actually use are decoded.
+type dumpPage struct {
+	Title     string    `xml:"title"`
+	Namespace int       `xml:"ns"`
+	Redirect  *struct{} `xml:"redirect"`
+	Revision  struct {
+		Timestamp string `xml:"timestamp"`
+		Text      string `xml:"text"`
+	} `xml:"revision"`
+}
+
+// dumpScan records what a candidate list was built from, so that it can be reused
+// until either the dump or the rules change
+type dumpScan struct {
+	DumpPath    string
+	DumpSize    int64
+	DumpModTime time.Time
+	RulesHash   string
+}
+
+// candidatesPath returns where the candidate list from a dump scan is kept
+func candidatesPath() string {
+	if config.PathToCandidates == "" {
+		return defaultCandidatesPath
+	}
+	return config.PathToCandidates
+}
+
+// scanDump reads the pages-articles dump at dumpPath, runs the regexes over the
+// text of every non-redirect page in it in a namespace the rules apply to, in
+// batches through the worker pool, and writes the titles of any article
+// that would be edited to a gzipped candidate list at outPath. The list is in
+// the same format as PathToArticles, so it can be processed in exactly the same way;
+// the candidates still have to be fetched live, as the dump will be out of date.
+func scanDump(dumpPath, outPath string, regexes map[string]STRegex) (candidates uint64) {
+	file, err := os.Open(dumpPath)
+	if err != nil {
+		ybtools.PanicErr("Failed to open PathToDump with error ", err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = bufio.NewReader(file)
+	switch {
+	case strings.HasSuffix(dumpPath, ".bz2"):
+		reader = bzip2.NewReader(reader)
+	case strings.HasSuffix(dumpPath, ".gz"):
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			ybtools.PanicErr("Failed to create gzip reader for dump with error ", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	// the old record no longer describes what's in outPath once we start writing to it
+	if err := os.Remove(dumpScanPath(outPath)); err != nil && !os.IsNotExist(err) {
+		ybtools.PanicErr("Failed to remove old dump scan record with error ", err)
+	}
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		ybtools.PanicErr("Failed to create candidates file with error ", err)
+	}
+
+	writer := gzip.NewWriter(outFile)
+	// Header line, to match the titles dump
+	if _, err := writer.Write([]byte("page_title\n")); err != nil {
+		ybtools.PanicErr("Failed to write to candidates file with error ", err)
+	}
+
+	// only look at pages in namespaces that at least one rule applies to
+	namespaces := map[int]bool{}
+	for _, namespace := range ruleNamespaces(regexes) {
+		namespaces[namespace] = true
+	}
+
+	var pagesScanned uint64
+	var batch []fetchedPage
+	decoder := xml.NewDecoder(reader)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			ybtools.PanicErr("Failed to read dump with error ", err)
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok || element.Name.Local != "page" {
+			continue
+		}
+
+		var page dumpPage
+		if err := decoder.DecodeElement(&page, &element); err != nil {
+			ybtools.PanicErr("Failed to decode page from dump with error ", err)
+		}
+
+		pagesScanned++
+		if pagesScanned%dumpProgressInterval == 0 {
+			log.Println("Scanned", pagesScanned, "pages from dump, found", candidates, "candidates so far")
+		}
+
+		if !namespaces[page.Namespace] || page.Redirect != nil || !ybtools.BotAllowed(page.Revision.Text) {
+			continue
+		}
+
+		batch = append(batch, fetchedPage{
+			title:     page.Title,
+			namespace: page.Namespace,
+			text:      page.Revision.Text,
+			revTS:     page.Revision.Timestamp,
+		})
+		if len(batch) == batchLimit {
+			candidates += matchDumpBatch(batch, regexes, writer)
+			batch = batch[:0]
+		}
+	}
+	candidates += matchDumpBatch(batch, regexes, writer)
+
+	if err := writer.Close(); err != nil {
+		ybtools.PanicErr("Failed to finish writing candidates file with error ", err)
+	}
+	if err := outFile.Close(); err != nil {
+		ybtools.PanicErr("Failed to close candidates file with error ", err)
+	}
+
+	log.Println("Finished scanning dump;", pagesScanned, "pages scanned,", candidates, "candidates found")
+	return
+}
+
+// matchDumpBatch matches a batch of pages from the dump in the worker pool, then
+// writes the titles of the ones that would be edited to writer, in dump order.
+// Only this goroutine ever writes, so the candidates file doesn't need a lock.
+func matchDumpBatch(batch []fetchedPage, regexes map[string]STRegex, writer io.Writer) (candidates uint64) {
+	matched := make([]bool, len(batch))
+	inPool(len(batch), func(i int) {
+		matches, _ := matchArticle(batch[i], regexes, false)
+		matched[i] = len(matches) > 0
+	})
+
+	for i, page := range batch {
+		if matched[i] {
+			if _, err := writer.Write([]byte(strings.ReplaceAll(page.title, " ", "_") + "\n")); err != nil {
+				ybtools.PanicErr("Failed to write to candidates file with error ", err)
+			}
+			candidates++
+		}
+	}
+	return
+}
+
+// dumpScanPath returns where the record of the scan that built outPath is kept
+func dumpScanPath(outPath string) string {
+	return outPath + ".scan"
+}
+
+// newDumpScan describes a scan of the dump at dumpPath with the rules in rulesHash
+func newDumpScan(dumpPath, rulesHash string) dumpScan {
+	info, err := os.Stat(dumpPath)
+	if err != nil {
+		ybtools.PanicErr("Failed to stat PathToDump with error ", err)
+	}
+	return dumpScan{DumpPath: dumpPath, DumpSize: info.Size(), DumpModTime: info.ModTime().UTC(), RulesHash: rulesHash}
+}
+
+// candidatesCurrent returns whether the candidate list at outPath was built from
+// the dump at dumpPath as it is now, with the rules in rulesHash, so doesn't need rebuilding
+func candidatesCurrent(dumpPath, outPath, rulesHash string) bool {
+	if _, err := os.Stat(outPath); err != nil {
+		return false
+	}
+	scanJSON, err := ioutil.ReadFile(dumpScanPath(outPath))
+	if err != nil {
+		return false
+	}
+	var saved dumpScan
+	if err := json.Unmarshal(scanJSON, &saved); err != nil {
+		log.Println("Dump scan record is corrupt, so rescanning. Error was", err)
+		return false
+	}
+	current := newDumpScan(dumpPath, rulesHash)
+	return saved.DumpPath == current.DumpPath && saved.DumpSize == current.DumpSize &&
+		saved.DumpModTime.Equal(current.DumpModTime) && saved.RulesHash == current.RulesHash
+}
+
+// recordDumpScan notes that the candidate list at outPath has been built from the
+// dump at dumpPath with the rules in rulesHash
+func recordDumpScan(dumpPath, outPath, rulesHash string) {
+	scanJSON, err := json.Marshal(newDumpScan(dumpPath, rulesHash))
+	if err != nil {
+		ybtools.PanicErr("Failed to serialise dump scan record with error ", err)
+	}
+	if err := writeFileAtomic(dumpScanPath(outPath), scanJSON); err != nil {
+		ybtools.PanicErr("Failed to write dump scan record with error ", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScanDump(t *testing.T) {
+	setupFlowTest(t)
+	tmpDir, err := ioutil.TempDir("", "scantag-dump")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// testdata/dump.xml.gz has a redirect, a talk page and a nobots page that would all
+	// otherwise match, as well as a page that's already tagged and one that doesn't match
+	outPath := filepath.Join(tmpDir, "candidates.gz")
+	if candidates := scanDump(filepath.Join("testdata", "dump.xml.gz"), outPath, regexes); candidates != 2 {
+		t.Errorf("scanDump found %d candidates, want 2", candidates)
+	}
+
+	file, err := os.Open(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "page_title\nUnsourced\nStub_article\n"; string(got) != want {
+		t.Errorf("scanDump wrote candidates:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCandidatesCurrent(t *testing.T) {
+	setupFlowTest(t)
+	tmpDir, err := ioutil.TempDir("", "scantag-dump")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dumpPath := filepath.Join(tmpDir, "dump.xml.gz")
+	dump, err := ioutil.ReadFile(filepath.Join("testdata", "dump.xml.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dumpPath, dump, 0644); err != nil {
+		t.Fatal(err)
+	}
+	outPath := filepath.Join(tmpDir, "candidates.gz")
+
+	if candidatesCurrent(dumpPath, outPath, "rules") {
+		t.Error("candidatesCurrent is true before the dump has been scanned")
+	}
+
+	scanDump(dumpPath, outPath, regexes)
+	recordDumpScan(dumpPath, outPath, "rules")
+	if !candidatesCurrent(dumpPath, outPath, "rules") {
+		t.Error("candidatesCurrent is false straight after scanning the dump")
+	}
+	if candidatesCurrent(dumpPath, outPath, "otherrules") {
+		t.Error("candidatesCurrent is true after the rules have changed")
+	}
+
+	// a new dump dropped in at the same path
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(dumpPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if candidatesCurrent(dumpPath, outPath, "rules") {
+		t.Error("candidatesCurrent is true after the dump has changed")
+	}
+
+	// starting a rescan invalidates the old record, even if the rescan never finishes
+	recordDumpScan(dumpPath, outPath, "rules")
+	scanDump(dumpPath, outPath, regexes)
+	if candidatesCurrent(dumpPath, outPath, "rules") {
+		t.Error("candidatesCurrent is true after a rescan that wasn't recorded")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"cgt.name/pkg/go-mwclient"
+	"github.com/antonholmquist/jason"
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+// exclusionList is a set of titles, and title prefixes, that shouldn't be touched
+type exclusionList struct {
+	titles   map[string]bool
+	prefixes []string
+}
+
+// exclusionSet holds the exclusions from ExclusionsJSONPageID, both for the whole bot
+// and for individual rules, keyed by the rule's ID.
+type exclusionSet struct {
+	global exclusionList
+	rules  map[string]exclusionList
+}
+
+// The exclusions in use, reloaded alongside the regexes
+var exclusions exclusionSet
+
+// normaliseTitle puts a title into the form the API gives titles in, so that
+// titles from the titles file, the API and the exclusion list can be compared
+func normaliseTitle(title string) string {
+	title = strings.TrimSpace(strings.ReplaceAll(title, "_", " "))
+	first, size := utf8.DecodeRuneInString(title)
+	if first == utf8.RuneError {
+		return title
+	}
+	return string(unicode.ToUpper(first)) + title[size:]
+}
+
+// loadExclusions replaces the exclusions in use with those from ExclusionsJSONPageID,
+// or with none at all if it isn't set.
+func loadExclusions(w *mwclient.Client) {
+	exclusions = exclusionSet{}
+	if config.ExclusionsJSONPageID == "" {
+		return
+	}
+
+	exclusionsJSON := loadJSONFromPageID(w, config.ExclusionsJSONPageID)
+	var err error
+	exclusions, err = parseExclusions(exclusionsJSON)
+	if err != nil {
+		ybtools.PanicErr("Exclusions JSON is invalid! Error was ", err)
+	}
+	log.Println("Loaded", len(exclusions.global.titles), "excluded titles and", len(exclusions.global.prefixes),
+		"excluded prefixes, plus exclusions for", len(exclusions.rules), "rules")
+}
+
+func parseExclusions(value *jason.Object) (set exclusionSet, err error) {
+	if set.global, err = parseExclusionList(value); err != nil {
+		return
+	}
+
+	rules, missingErr := value.GetObject("rules")
+	if missingErr != nil {
+		if _, notThereErr := value.GetValue("rules"); notThereErr == nil {
+			err = fmt.Errorf("rules must be an object of rule IDs to exclusions")
+		}
+		return
+	}
+
+	set.rules = map[string]exclusionList{}
+	for key, ruleValue := range rules.Map() {
+		ruleObject, objectErr := ruleValue.Object()
+		if objectErr != nil {
+			err = fmt.Errorf("exclusions for rule `%s` must be an object", key)
+			return
+		}
+		if set.rules[key], err = parseExclusionList(ruleObject); err != nil {
+			err = fmt.Errorf("exclusions for rule `%s` are invalid: %s", key, err)
+			return
+		}
+	}
+	return
+}
+
+func parseExclusionList(value *jason.Object) (list exclusionList, err error) {
+	list.titles = map[string]bool{}
+	if _, missingErr := value.GetValue("titles"); missingErr == nil {
+		titles, arrayErr := value.GetStringArray("titles")
+		if arrayErr != nil {
+			return list, fmt.Errorf("titles must be an array of titles")
+		}
+		for _, title := range titles {
+			list.titles[normaliseTitle(title)] = true
+		}
+	}
+
+	if _, missingErr := value.GetValue("prefixes"); missingErr == nil {
+		prefixes, arrayErr := value.GetStringArray("prefixes")
+		if arrayErr != nil {
+			return list, fmt.Errorf("prefixes must be an array of title prefixes")
+		}
+		for _, prefix := range prefixes {
+			// unlike titles, prefixes can end in a space, e.g. "List of "
+			list.prefixes = append(list.prefixes, normaliseTitle(prefix)+trailingSpace(prefix))
+		}
+	}
+	return
+}
+
+func trailingSpace(prefix string) string {
+	prefix = strings.ReplaceAll(prefix, "_", " ")
+	return prefix[len(strings.TrimRight(prefix, " ")):]
+}
+
+// excludes returns whether title is one of the list's titles, or starts with one of its prefixes
+func (list exclusionList) excludes(title string) bool {
+	title = normaliseTitle(title)
+	if list.titles[title] {
+		return true
+	}
+	for _, prefix := range list.prefixes {
+		if strings.HasPrefix(title, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the titles that aren't excluded from the whole bot
+func (set exclusionSet) filter(titles []string) []string {
+	var filtered []string
+	for _, title := range titles {
+		if !set.global.excludes(title) {
+			filtered = append(filtered, title)
+		}
+	}
+	return filtered
+}
+
+// excludesRule returns whether title is excluded from the rule with the given ID
+func (set exclusionSet) excludesRule(title, id string) bool {
+	list, ok := set.rules[id]
+	return ok && list.excludes(title)
+}
+
+/* The JSON file containing exclusions is expected to be of this format, with every part optional:
+
+{
+	"titles": ["Titles that Scantag shouldn't touch at all", "These aren't even fetched"],
+	"prefixes": ["List of ", "Titles starting with any of these are excluded as well"],
+	"rules": {
+		"The ID of a rule in Scantag.json": {
+			"titles": ["Titles that just this rule shouldn't touch"],
+			"prefixes": ["Prefixes that just this rule shouldn't touch"]
+		}
+	}
+}
+
+Underscores and spaces are the same thing, and the first letter isn't case sensitive, as on the wiki.
+
+*/
@@ -0,0 +1,93 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/antonholmquist/jason"
+)
+
+func TestExclusionList(t *testing.T) {
+	value, _ := jason.NewObjectFromBytes([]byte(`{"titles": ["Main_Page", "foo"], "prefixes": ["List of "]}`))
+	list, err := parseExclusionList(value)
+	if err != nil {
+		t.Fatal("parseExclusionList failed:", err)
+	}
+
+	for title, want := range map[string]bool{
+		"Main Page":      true,
+		"Main_Page":      true,
+		"Foo":            true,
+		"Foo bar":        false,
+		"List_of_things": true,
+		"Listless":       false,
+		"list of things": true,
+	} {
+		if got := list.excludes(title); got != want {
+			t.Errorf("excludes(%q) gave %v, want %v", title, got, want)
+		}
+	}
+}
+
+func TestParseExclusionsInvalid(t *testing.T) {
+	for _, exclusionsJSON := range []string{`{"titles": "Foo"}`, `{"prefixes": [1]}`, `{"rules": []}`, `{"rules": {"foo": {"titles": 5}}}`} {
+		value, _ := jason.NewObjectFromBytes([]byte(exclusionsJSON))
+		if _, err := parseExclusions(value); err == nil {
+			t.Errorf("parseExclusions accepted %s", exclusionsJSON)
+		}
+	}
+}
+
+func TestProcessBatchExclusions(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	config.ExclusionsJSONPageID = strconv.Itoa(fw.setPage("User:Yapperbot/Scantag.exclusions.json", `{
+		"titles": ["Excluded"],
+		"prefixes": ["List of "],
+		"rules": {
+			"unsourced": {"titles": ["Stub with a claim"]}
+		}
+	}`))
+	loadExclusions(w)
+
+	fw.setPage("Excluded", "This is an unsourced claim.")
+	fw.setPage("List of claims", "This is an unsourced claim.")
+	fw.setPage("Included", "This is an unsourced claim.")
+	fw.setPage("Stub with a claim", "This is an unsourced claim (stub)")
+
+	var processed uint64
+	processBatch(w, []string{"Excluded", "List_of_claims", "Included", "Stub_with_a_claim"}, &processed)
+
+	if processed != 4 {
+		t.Errorf("processBatch counted %d titles, want 4", processed)
+	}
+	for _, title := range []string{"Excluded", "List of claims"} {
+		if text := fw.text(title); text != "This is an unsourced claim." {
+			t.Errorf("Excluded page %s was edited:\n%s", title, text)
+		}
+	}
+	if text := fw.text("Included"); !strings.HasPrefix(text, "{{Unreferenced") {
+		t.Errorf("Included page wasn't tagged:\n%s", text)
+	}
+	if text := fw.text("Stub with a claim"); strings.Contains(text, "{{Unreferenced") || !strings.Contains(text, "{{stub}}") {
+		t.Errorf("Page excluded from one rule should only have been tagged by the other:\n%s", text)
+	}
+}
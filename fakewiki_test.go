@@ -0,0 +1,396 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+)
+
+// The fake wiki's clock starts here, and ticks one second for every change made
+var fakeWikiEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// fakePage is a page on the fake wiki
+type fakePage struct {
+	id        int
+	title     string
+	text      string
+	revid     int
+	timestamp string
+	user      string
+	// the timestamp of the page's first revision
+	created string
+}
+
+// fakeEdit records an edit made to the fake wiki through the API
+type fakeEdit struct {
+	title   string
+	section string
+	summary string
+	text    string
+}
+
+// fakeChange is an entry in the fake wiki's recent changes
+type fakeChange struct {
+	rcid      int
+	title     string
+	timestamp string
+	user      string
+	new       bool
+}
+
+// fakeWiki is an in-process stand-in for the MediaWiki API, implementing just
+// enough of action=query and action=edit for Scantag to run against it.
+type fakeWiki struct {
+	sync.Mutex
+	pages  map[string]*fakePage
+	byID   map[int]*fakePage
+	nextID int
+	clock  int
+	edits  []fakeEdit
+	// changes is every save, in the order they were made
+	changes []fakeChange
+	// recentChangesLimit is the most changes returned by one list=recentchanges query
+	recentChangesLimit int
+
+	// editErrors holds error codes to return for edits to a title, one per edit
+	editErrors map[string][]string
+	// interventions holds text that another user will save to a title just
+	// before our next edit to it, causing an edit conflict
+	interventions map[string]string
+}
+
+// newFakeWiki starts a fake wiki, returning it along with a client pointed at it.
+// The server is shut down when the test finishes.
+func newFakeWiki(t *testing.T) (*fakeWiki, *mwclient.Client) {
+	fw := &fakeWiki{
+		pages:         map[string]*fakePage{},
+		byID:          map[int]*fakePage{},
+		nextID:        1,
+		editErrors:    map[string][]string{},
+		interventions: map[string]string{},
+
+		recentChangesLimit: 500,
+	}
+
+	server := httptest.NewServer(fw)
+	t.Cleanup(server.Close)
+
+	w, err := mwclient.New(server.URL+"/w/api.php", "Scantag tests")
+	if err != nil {
+		t.Fatal("Failed to create client for fake wiki:", err)
+	}
+	return fw, w
+}
+
+// tick moves the fake clock on, returning the new time as a MediaWiki timestamp
+func (fw *fakeWiki) tick() string {
+	fw.clock++
+	return fakeWikiEpoch.Add(time.Duration(fw.clock) * time.Second).Format(time.RFC3339)
+}
+
+// setPage creates or replaces a page, returning its page ID
+func (fw *fakeWiki) setPage(title, text string) int {
+	fw.Lock()
+	defer fw.Unlock()
+	return fw.save(title, text, "Someone else").id
+}
+
+// save must be called with the lock held
+func (fw *fakeWiki) save(title, text, user string) *fakePage {
+	page, ok := fw.pages[title]
+	if !ok {
+		page = &fakePage{id: fw.nextID, title: title}
+		fw.nextID++
+		fw.pages[title] = page
+		fw.byID[page.id] = page
+	}
+	page.text = text
+	page.revid++
+	page.user = user
+	page.timestamp = fw.tick()
+	if page.created == "" {
+		page.created = page.timestamp
+	}
+	fw.changes = append(fw.changes, fakeChange{
+		rcid:      len(fw.changes) + 1,
+		title:     title,
+		timestamp: page.timestamp,
+		user:      user,
+		new:       page.revid == 1,
+	})
+	return page
+}
+
+// text returns the current text of a page, or an empty string if it doesn't exist
+func (fw *fakeWiki) text(title string) string {
+	fw.Lock()
+	defer fw.Unlock()
+	if page, ok := fw.pages[title]; ok {
+		return page.text
+	}
+	return ""
+}
+
+// transcript describes every edit made through the API, for comparing against golden files
+func (fw *fakeWiki) transcript() string {
+	fw.Lock()
+	defer fw.Unlock()
+
+	var builder strings.Builder
+	for i, edit := range fw.edits {
+		fmt.Fprintf(&builder, "=== Edit %d: %s ===\n", i+1, edit.title)
+		if edit.section != "" {
+			fmt.Fprintf(&builder, "Section: %s\n", edit.section)
+		}
+		fmt.Fprintf(&builder, "Summary: %s\n%s\n\n", edit.summary, edit.text)
+	}
+	return builder.String()
+}
+
+func (fw *fakeWiki) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = r.ParseMultipartForm(32 << 20)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	var resp interface{}
+	switch r.Form.Get("action") {
+	case "query":
+		resp = fw.query(r)
+	case "edit":
+		resp = fw.edit(r)
+	default:
+		resp = apiError("badvalue", "Unrecognised action")
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+}
+
+func apiError(code, info string) map[string]interface{} {
+	return map[string]interface{}{"error": map[string]interface{}{"code": code, "info": info}}
+}
+
+func (fw *fakeWiki) query(r *http.Request) interface{} {
+	if r.Form.Get("meta") == "tokens" {
+		return map[string]interface{}{
+			"batchcomplete": true,
+			"query": map[string]interface{}{
+				"tokens": map[string]interface{}{r.Form.Get("type") + "token": "faketoken+\\"},
+			},
+		}
+	}
+
+	if r.Form.Get("list") == "recentchanges" {
+		return fw.recentChanges(r)
+	}
+
+	props := strings.Split(r.Form.Get("prop"), "|")
+	firstRevision := r.Form.Get("rvdir") == "newer"
+	var pages []interface{}
+	if titles := r.Form.Get("titles"); titles != "" {
+		for _, title := range strings.Split(titles, "|") {
+			title = strings.ReplaceAll(title, "_", " ")
+			pages = append(pages, fw.pageInfo(fw.pages[title], title, props, firstRevision))
+		}
+	}
+	if pageids := r.Form.Get("pageids"); pageids != "" {
+		for _, pageid := range strings.Split(pageids, "|") {
+			id, _ := strconv.Atoi(pageid)
+			pages = append(pages, fw.pageInfo(fw.byID[id], "", props, firstRevision))
+		}
+	}
+
+	resp := map[string]interface{}{
+		"batchcomplete": true,
+		"query":         map[string]interface{}{"pages": pages},
+	}
+	if r.Form.Get("curtimestamp") != "" {
+		resp["curtimestamp"] = fakeWikiEpoch.Add(time.Duration(fw.clock) * time.Second).Format(time.RFC3339)
+	}
+	return resp
+}
+
+// recentChanges implements list=recentchanges with rcdir=newer, paging with rccontinue
+// (a timestamp in MediaWiki's format, then the rcid to start from)
+func (fw *fakeWiki) recentChanges(r *http.Request) interface{} {
+	var fromTS string
+	var fromID int
+	if parts := strings.SplitN(r.Form.Get("rccontinue"), "|", 2); len(parts) == 2 {
+		fromTS = parts[0]
+		fromID, _ = strconv.Atoi(parts[1])
+	}
+	namespaces := map[int]bool{}
+	for _, namespace := range strings.Split(r.Form.Get("rcnamespace"), "|") {
+		ns, _ := strconv.Atoi(namespace)
+		namespaces[ns] = true
+	}
+
+	changes := []interface{}{}
+	resp := map[string]interface{}{"batchcomplete": true}
+	for _, change := range fw.changes {
+		parsed, _ := time.Parse(time.RFC3339, change.timestamp)
+		ts := parsed.Format(mwTimestampFormat)
+		if ts < fromTS || (ts == fromTS && change.rcid < fromID) {
+			continue
+		}
+		if !namespaces[fakeNamespace(change.title)] || change.user == r.Form.Get("rcexcludeuser") {
+			continue
+		}
+		if len(changes) == fw.recentChangesLimit {
+			resp["continue"] = map[string]interface{}{"rccontinue": fmt.Sprintf("%s|%d", ts, change.rcid), "continue": "-||"}
+			break
+		}
+		changeType := "edit"
+		if change.new {
+			changeType = "new"
+		}
+		changes = append(changes, map[string]interface{}{
+			"type":      changeType,
+			"ns":        fakeNamespace(change.title),
+			"title":     change.title,
+			"rcid":      change.rcid,
+			"timestamp": change.timestamp,
+		})
+	}
+	resp["query"] = map[string]interface{}{"recentchanges": changes}
+	return resp
+}
+
+// The namespaces the fake wiki knows about; everything else is in mainspace
+var fakeNamespaces = map[string]int{"Talk": 1, "User": 2, "User talk": 3, "Category": 14}
+
+// Category links, as they'd be parsed out of a page by MediaWiki
+var fakeCategoryRegex = regexp.MustCompile(`\[\[\s*[Cc]ategory\s*:\s*([^|\]]+?)\s*(?:\|[^\]]*)?\]\]`)
+
+func fakeNamespace(title string) int {
+	if parts := strings.SplitN(title, ":", 2); len(parts) == 2 {
+		return fakeNamespaces[parts[0]]
+	}
+	return 0
+}
+
+func (fw *fakeWiki) pageInfo(page *fakePage, title string, props []string, firstRevision bool) map[string]interface{} {
+	if page == nil {
+		return map[string]interface{}{"ns": fakeNamespace(title), "title": title, "missing": true}
+	}
+	info := map[string]interface{}{
+		"pageid": page.id,
+		"ns":     fakeNamespace(page.title),
+		"title":  page.title,
+	}
+	for _, prop := range props {
+		switch prop {
+		case "revisions":
+			if firstRevision {
+				// we don't keep old revisions, so this is all we can give
+				info["revisions"] = []interface{}{map[string]interface{}{"timestamp": page.created}}
+				continue
+			}
+			info["revisions"] = []interface{}{map[string]interface{}{
+				"revid":     page.revid,
+				"user":      page.user,
+				"timestamp": page.timestamp,
+				"slots": map[string]interface{}{
+					"main": map[string]interface{}{"contentmodel": "wikitext", "content": page.text},
+				},
+			}}
+		case "categories":
+			var categories []interface{}
+			for _, match := range fakeCategoryRegex.FindAllStringSubmatch(page.text, -1) {
+				categories = append(categories, map[string]interface{}{"ns": 14, "title": "Category:" + match[1]})
+			}
+			if categories != nil {
+				info["categories"] = categories
+			}
+		}
+	}
+	return info
+}
+
+func (fw *fakeWiki) edit(r *http.Request) interface{} {
+	title := r.Form.Get("title")
+	if pageid := r.Form.Get("pageid"); pageid != "" {
+		id, _ := strconv.Atoi(pageid)
+		page, ok := fw.byID[id]
+		if !ok {
+			return apiError("nosuchpageid", "There is no page with ID "+pageid)
+		}
+		title = page.title
+	}
+
+	if text, ok := fw.interventions[title]; ok {
+		delete(fw.interventions, title)
+		fw.save(title, text, "Someone else")
+	}
+
+	if codes := fw.editErrors[title]; len(codes) > 0 {
+		fw.editErrors[title] = codes[1:]
+		return apiError(codes[0], "Fake error")
+	}
+
+	page := fw.pages[title]
+	if base := r.Form.Get("basetimestamp"); base != "" && page != nil && base != page.timestamp {
+		return apiError("editconflict", "Edit conflict")
+	}
+
+	text := r.Form.Get("text")
+	if r.Form.Get("section") == "new" {
+		var existing string
+		if page != nil {
+			existing = page.text + "\n\n"
+		}
+		text = existing + "== " + r.Form.Get("sectiontitle") + " ==\n" + text
+	}
+
+	fw.edits = append(fw.edits, fakeEdit{
+		title:   title,
+		section: r.Form.Get("section"),
+		summary: r.Form.Get("summary"),
+		text:    r.Form.Get("text"),
+	})
+
+	result := map[string]interface{}{"result": "Success", "title": title}
+	if page != nil && page.text == text {
+		result["nochange"] = true
+	} else {
+		fw.save(title, text, botUser)
+	}
+	return map[string]interface{}{"edit": result}
+}
@@ -0,0 +1,418 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files in testdata with the current output")
+
+// The rules used by the flow tests. Only the first has an ID; the other is identified
+// by the hash of its regex.
+const flowTestRules string = `{
+	"unsourced claim": {
+		"id": "unsourced",
+		"detected": "an unsourced claim",
+		"noTagIf": "\\{\\{unreferenced",
+		"prefix": "{{Unreferenced|date=October 2026}}\n"
+	},
+	"\\((stub|short)\\)": {
+		"detected": "a stub marker",
+		"noTagIf": false,
+		"suffix": "\n{{${1}}}"
+	}
+}`
+
+// setupFlowTest points all of the bot's global state at a fresh fake wiki,
+// putting it all back once the test is done.
+func setupFlowTest(t *testing.T) (*fakeWiki, *mwclient.Client) {
+	fw, w := newFakeWiki(t)
+
+	tmpDir, err := ioutil.TempDir("", "scantag-test")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+
+	oldConfig, oldRegexes, oldExclusions, oldDryRun := config, regexes, exclusions, dryRun
+	oldEditDelay, oldBackoff, oldCanEdit := editDelay, editConflictBackoff, canEdit
+	t.Cleanup(func() {
+		config, regexes, exclusions, dryRun = oldConfig, oldRegexes, oldExclusions, oldDryRun
+		editDelay, editConflictBackoff, canEdit = oldEditDelay, oldBackoff, oldCanEdit
+		ruleCounts = nil
+		os.RemoveAll(tmpDir)
+	})
+
+	config = Config{
+		RegexesJSONPageID: strconv.Itoa(fw.setPage("User:Yapperbot/Scantag.json", flowTestRules)),
+		RuleCountsPath:    filepath.Join(tmpDir, "rulecounts"),
+		DryRunReportPath:  filepath.Join(tmpDir, "dryrun"),
+	}
+	ruleCounts = nil
+	exclusions = exclusionSet{}
+	protectedReportEntries = nil
+	metrics = scantagMetrics{ruleMatches: map[string]uint64{}, apiErrors: map[string]uint64{}}
+	auditEncoder = nil
+	dryRun = false
+	editDelay = 0
+	editConflictBackoff = 0
+	canEdit = func() bool { return true }
+
+	loadRegexes(w)
+	return fw, w
+}
+
+// checkGolden compares got against testdata/name.golden, or rewrites the golden
+// file if the tests were run with -update.
+func checkGolden(t *testing.T, name, got string) {
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal("Failed to update golden file:", err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Failed to read golden file (run with -update to create it):", err)
+	}
+	if got != string(want) {
+		t.Errorf("Output doesn't match %s (run with -update if this is intended).\n%s", path,
+			unifiedDiff("want", "got", string(want), got))
+	}
+}
+
+func TestProcessBatch(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	config.ProtectedNotify = protectedNotifyTalk
+	config.AuditLogPath = filepath.Join(filepath.Dir(config.RuleCountsPath), "audit.jsonl")
+
+	fw.setPage("Unsourced", "This is an unsourced claim.")
+	fw.setPage("Hatnote", "{{About|the thing}}\nThis is an unsourced claim.")
+	fw.setPage("Stub", "A short article (stub)")
+	fw.setPage("Already tagged", "{{Unreferenced|date=May 2020}}\nThis is an unsourced claim.")
+	fw.setPage("Nobots", "{{nobots}}\nThis is an unsourced claim.")
+	fw.setPage("Clean", "Nothing to see here.")
+	fw.setPage("Protected", "This is an unsourced claim.")
+	fw.editErrors["Protected"] = []string{"protectedpage"}
+	fw.setPage("Deleted", "This is an unsourced claim.")
+	fw.editErrors["Deleted"] = []string{"pagedeleted"}
+	fw.setPage("Conflicted", "This is an unsourced claim.")
+	fw.interventions["Conflicted"] = "This is an unsourced claim, now expanded."
+	fw.setPage("Conflicted and tagged", "This is an unsourced claim.")
+	fw.interventions["Conflicted and tagged"] = "{{Unreferenced|date=October 2026}}\nThis is an unsourced claim."
+
+	var processed uint64
+	processBatch(w, []string{
+		"Unsourced", "Hatnote", "Stub", "Already_tagged", "Nobots", "Clean", "Missing",
+		"Protected", "Deleted", "Conflicted", "Conflicted_and_tagged",
+	}, &processed)
+
+	if processed != 11 {
+		t.Errorf("processBatch counted %d titles, want 11", processed)
+	}
+	checkGolden(t, "batch", fw.transcript())
+	checkGolden(t, "batch-audit", readAuditLog(t))
+
+	var exposition strings.Builder
+	metrics.write(&exposition)
+	// the only thing that changes from one run to the next is how long it took
+	checkGolden(t, "batch-metrics", batchDurationRegex.ReplaceAllString(exposition.String(), "${1} <duration>"))
+}
+
+var batchDurationRegex = regexp.MustCompile(`(?m)^(scantag_batch_duration_seconds_sum) .*$`)
+
+// readAuditLog returns the lines of the audit log without their times, sorted, as
+// pages are matched in parallel so the lines for different pages can come in any order
+func readAuditLog(t *testing.T) string {
+	auditJSON, err := ioutil.ReadFile(config.AuditLogPath)
+	if err != nil {
+		t.Fatal("Failed to read audit log:", err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(auditJSON)), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Audit log line %q isn't valid JSON: %s", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Time); err != nil {
+			t.Errorf("Audit log line %q has an invalid time", line)
+		}
+		entry.Time = ""
+		stripped, _ := json.Marshal(entry)
+		lines = append(lines, string(stripped))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestProcessBatchBlocked(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	fw.setPage("Unsourced", "This is an unsourced claim.")
+	fw.editErrors["Unsourced"] = []string{"blocked"}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("processBatch didn't die when the bot was blocked")
+		}
+	}()
+
+	var processed uint64
+	processBatch(w, []string{"Unsourced"}, &processed)
+}
+
+func TestProcessBatchDryRun(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	dryRun = true
+	fw.setPage("Unsourced", "{{Short description|A page}}\nThis is an unsourced claim.\n\nMore text.")
+
+	var processed uint64
+	processBatch(w, []string{"Unsourced"}, &processed)
+
+	if transcript := fw.transcript(); transcript != "" {
+		t.Errorf("Dry run edited the wiki:\n%s", transcript)
+	}
+
+	report, err := ioutil.ReadFile(filepath.Join(config.DryRunReportPath, "Unsourced.diff"))
+	if err != nil {
+		t.Fatal("Failed to read dry run report:", err)
+	}
+	checkGolden(t, "dryrun", string(report))
+}
+
+func TestCreateSandbox(t *testing.T) {
+	fw, w := setupFlowTest(t)
+
+	// the rows should come out in priority order, with the invalid rule last
+	sandboxJSONPageID := fw.setPage("User:Yapperbot/Scantag.sandbox.json", `{
+		"(unclosed": {
+			"detected": "nothing",
+			"noTagIf": false
+		},
+		"\\((stub|short)\\)": {
+			"id": "stub",
+			"detected": "a stub marker",
+			"noTagIf": false,
+			"suffix": "\n{{${1}}}",
+			"priority": 5,
+			"group": "stubs"
+		},
+		"unsourced claim": {
+			"id": "unsourced",
+			"task": "Tag unsourced claims",
+			"example": "An unsourced claim",
+			"detected": "an unsourced claim",
+			"noTagIf": "\\{\\{unreferenced",
+			"prefix": "{{Unreferenced}}\n",
+			"scope": "prose",
+			"conditions": {"all": [{"not": "<ref"}, {"any": [{"minBytes": 10}, "\\{\\{stub"]}]},
+			"testpage": "User:Yapperbot/Scantag.sandbox/tests/Unsourced"
+		}
+	}`)
+	config.SandboxJSONPageID = strconv.Itoa(sandboxJSONPageID)
+	config.SandboxPageID = strconv.Itoa(fw.setPage("User:Yapperbot/Scantag.sandbox", "Old sandbox"))
+	fw.setPage("User:Yapperbot/Scantag.sandbox/tests/Unsourced", "This is an unsourced claim.")
+
+	createSandbox(w)
+	checkGolden(t, "sandbox", fw.transcript())
+
+	// with no changes to the JSON, running again shouldn't do anything
+	edits := len(fw.edits)
+	createSandbox(w)
+	if len(fw.edits) != edits {
+		t.Errorf("Sandbox was updated again with no changes to the JSON:\n%s", fw.transcript())
+	}
+
+	if text := fw.text("User:Yapperbot/Scantag.sandbox/tests/Unsourced"); strings.Count(text, "{{Unreferenced}}") != 1 {
+		t.Errorf("Test page should have been tagged exactly once, but was:\n%s", text)
+	}
+}
+
+func TestLoadRegexesReplacesOldRules(t *testing.T) {
+	_, w := setupFlowTest(t)
+
+	firstHash := loadRegexes(w)
+	if len(regexes) != 2 {
+		t.Fatalf("Loaded %d regexes, want 2", len(regexes))
+	}
+	if secondHash := loadRegexes(w); secondHash != firstHash {
+		t.Errorf("Rules hash changed between loads of the same rules: %s then %s", firstHash, secondHash)
+	}
+	if len(regexes) != 2 {
+		t.Errorf("Reloading the rules left %d regexes, want 2", len(regexes))
+	}
+}
+
+func TestProcessBatchPlacementOrder(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	config.RegexesJSONPageID = strconv.Itoa(fw.setPage("User:Yapperbot/Scantag.json", `{
+		"claim": {
+			"id": "high",
+			"detected": "a claim",
+			"noTagIf": false,
+			"prefix": "{{High}}\n",
+			"placement": "section:History",
+			"priority": 5
+		},
+		"claim\\.": {
+			"id": "low",
+			"detected": "a claim with a full stop",
+			"noTagIf": false,
+			"prefix": "{{Low}}\n",
+			"placement": "section:History",
+			"priority": 1
+		},
+		"lead": {
+			"id": "before",
+			"detected": "a lead",
+			"noTagIf": false,
+			"prefix": "{{Before}}\n",
+			"placement": "before:History"
+		},
+		"lead ": {
+			"id": "beforelater",
+			"detected": "a lead with a space",
+			"noTagIf": false,
+			"prefix": "{{Before later}}\n",
+			"placement": "before:History",
+			"priority": -1
+		}
+	}`))
+	loadRegexes(w)
+
+	fw.setPage("Placed", "The lead section.\n== History ==\nA claim.")
+
+	var processed uint64
+	processBatch(w, []string{"Placed"}, &processed)
+
+	want := "The lead section.\n{{Before}}\n{{Before later}}\n== History ==\n{{High}}\n{{Low}}\nA claim."
+	if text := fw.text("Placed"); text != want {
+		t.Errorf("Tags placed around the same heading came out as:\n%s\nwant:\n%s", text, want)
+	}
+}
+
+func TestProtectedReportConflict(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	config.ProtectedNotify = protectedNotifyReport
+	reportID := fw.setPage("User:Yapperbot/Scantag.protected", "* [[Earlier]]: detected something")
+	config.ProtectedReportPageID = strconv.Itoa(reportID)
+
+	fw.setPage("Protected", "This is an unsourced claim.")
+	fw.editErrors["Protected"] = []string{"protectedpage"}
+	// someone else edits the report between us fetching it and saving it
+	fw.interventions["User:Yapperbot/Scantag.protected"] = "* [[Earlier]]: detected something\n* [[Added by hand]]"
+
+	var processed uint64
+	processBatch(w, []string{"Protected"}, &processed)
+
+	if text := fw.text("User:Yapperbot/Scantag.protected"); strings.Contains(text, "[[Protected]]") || !strings.Contains(text, "[[Added by hand]]") {
+		t.Fatalf("The report was saved over someone else's edit:\n%s", text)
+	}
+	if len(protectedReportEntries) != 1 {
+		t.Fatalf("Failed report update left %d entries queued, want 1", len(protectedReportEntries))
+	}
+	// the protected article and the report both count, not just the article
+	if metrics.apiErrors["protectedpage"] != 1 || metrics.apiErrors["editconflict"] != 1 {
+		t.Errorf("API errors were counted as %v, want one protectedpage and one editconflict", metrics.apiErrors)
+	}
+
+	// the next time round, it should go through without losing the other edit
+	flushProtectedReport(w)
+	if text := fw.text("User:Yapperbot/Scantag.protected"); !strings.Contains(text, "[[Protected]]") || !strings.Contains(text, "[[Added by hand]]") {
+		t.Errorf("The report wasn't updated properly after an edit conflict:\n%s", text)
+	}
+	if len(protectedReportEntries) != 0 {
+		t.Errorf("Successful report update left %d entries queued", len(protectedReportEntries))
+	}
+}
+
+func TestProcessBatchGroupFallback(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	// the fake wiki's pages were all created in 2020, so the new article rule never holds
+	config.RegexesJSONPageID = strconv.Itoa(fw.setPage("User:Yapperbot/Scantag.json", `{
+		"claim": {
+			"id": "newclaim",
+			"detected": "a claim in a new article",
+			"noTagIf": false,
+			"prefix": "{{New unsourced}}\n",
+			"conditions": {"maxAgeDays": 30},
+			"group": "refs",
+			"priority": 5
+		},
+		"unsourced claim": {
+			"id": "unsourced",
+			"detected": "an unsourced claim",
+			"noTagIf": false,
+			"prefix": "{{Unreferenced}}\n",
+			"group": "refs"
+		}
+	}`))
+	loadRegexes(w)
+
+	fw.setPage("Old", "This is an unsourced claim.")
+
+	var processed uint64
+	processBatch(w, []string{"Old"}, &processed)
+
+	if text := fw.text("Old"); text != "{{Unreferenced}}\nThis is an unsourced claim." {
+		t.Errorf("The rest of the group should have applied once the first rule's conditions failed:\n%s", text)
+	}
+}
+
+func TestProtectedTalkNoticePerRule(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	config.ProtectedNotify = protectedNotifyTalk
+
+	fw.setPage("Protected", "This is an unsourced claim (stub)")
+	fw.setPage("Talk:Protected", "== Maintenance tags from Scantag ==\n"+fmt.Sprintf(protectedTalkMarker, "unsourced")+"\nAn earlier notice. ~~~~")
+	fw.editErrors["Protected"] = []string{"protectedpage", "protectedpage"}
+
+	var processed uint64
+	processBatch(w, []string{"Protected"}, &processed)
+
+	// the stub rule hasn't been posted about yet, but the unsourced one has
+	text := fw.text("Talk:Protected")
+	if strings.Count(text, fmt.Sprintf(protectedTalkMarker, "unsourced")) != 1 {
+		t.Errorf("Posted about the unsourced rule again:\n%s", text)
+	}
+	if strings.Count(text, fmt.Sprintf(protectedTalkMarker, "77cec40d859f")) != 1 || strings.Contains(text, "{{Unreferenced") {
+		t.Errorf("Didn't post about just the stub rule:\n%s", text)
+	}
+
+	// once both have been posted about, there's nothing more to say
+	processBatch(w, []string{"Protected"}, &processed)
+	if again := fw.text("Talk:Protected"); again != text {
+		t.Errorf("Posted again about rules that had already been posted about:\n%s", again)
+	}
+}
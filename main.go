@@ -24,28 +24,37 @@ import (
 	"flag"
 	"log"
 	"os"
-	"regexp"
-	"strings"
+	"time"
 
 	"cgt.name/pkg/go-mwclient"
-	"cgt.name/pkg/go-mwclient/params"
 	"github.com/mashedkeyboard/ybtools/v2"
 )
 
 // This is the maximum number of articles we process per batch
 const batchLimit int = 500
 
+// The account the bot runs as; its own edits are left out of recent changes
+const botUser string = "Yapperbot"
+
 var config Config
-var regexes = map[*regexp.Regexp]STRegex{}
+var regexes = map[string]STRegex{}
 var testTitle string
 var sandbox bool
+var dryRun bool
+var fromDump bool
+var resume bool
+var recentChanges bool
 
 func init() {
-	ybtools.SetupBot(ybtools.BotSettings{TaskName: "Scantag", BotUser: "Yapperbot"})
+	ybtools.SetupBot(ybtools.BotSettings{TaskName: "Scantag", BotUser: botUser})
 	ybtools.ParseTaskConfig(&config)
 
 	flag.StringVar(&testTitle, "test", "", "Test the regexes against a single title, rather than over all pages. Default is an empty string.")
 	flag.BoolVar(&sandbox, "sandbox", false, "Update the sandbox, rather than doing a run of the bot")
+	flag.BoolVar(&dryRun, "dry-run", false, "Write the edits the bot would make to diffs in DryRunReportPath, rather than saving them")
+	flag.BoolVar(&fromDump, "from-dump", false, "Scan the XML dump at PathToDump for candidates, and only fetch and process those, rather than every title in PathToArticles")
+	flag.BoolVar(&resume, "resume", false, "Resume from the last checkpoint, if the rules haven't changed since it was saved")
+	flag.BoolVar(&recentChanges, "recent-changes", false, "Poll recent changes for new and edited articles and process only those, rather than doing full passes")
 }
 
 func main() {
@@ -60,71 +69,52 @@ func main() {
 	if sandbox {
 		createSandbox(w)
 	} else {
+		serveMetrics()
+
 		// If we edit-limit out, ybtools panics. This means defers are run,
 		// so edit-limiting should still work.
 		defer ybtools.SaveEditLimit()
 
+		if recentChanges {
+			// in recent changes mode, a run lasts as long as the bot does
+			startRun()
+		}
+
 		for {
 			log.Println("Retrieving regexes")
 
-			regexesJSON := ybtools.LoadJSONFromPageID(config.RegexesJSONPageID)
-
-			for regex, content := range regexesJSON.Map() {
-				expression, stregex, _, err := processRegex(regex, content)
-				if err != nil {
-					ybtools.PanicErr(err)
-				}
-				regexes[expression] = stregex
-				log.Println("Found regex:", regex)
-			}
+			rulesHash := loadRegexes(w)
+			loadExclusions(w)
 
 			log.Println("Starting processing")
 
-			if testTitle == "" {
-				file, err := os.Open(config.PathToArticles)
-				if err != nil {
-					ybtools.PanicErr("Failed to open PathToArticles with error ", err)
-				}
-				defer file.Close()
-
-				reader, err := gzip.NewReader(file)
-				if err != nil {
-					ybtools.PanicErr("Failed to create gzip reader with error ", err)
-				}
-				defer reader.Close()
-
-				scanner := bufio.NewScanner(reader)
-
-				// Ignore the first line; it's a header, page_title
-				scanner.Scan()
-
-				// at the point at which Wikipedia has more articles than can fit in a uint64, well, this will be fairly obsolete anyway >:)
-				var totalArticlesProcessed uint64
+			if recentChanges {
+				processRecentChanges(w)
+				time.Sleep(recentChangesInterval())
+				continue
+			}
 
-				var batch []string
-				for scanner.Scan() {
-					// append our new title to our batch
-					batch = append(batch, scanner.Text())
-					if len(batch) == batchLimit {
-						log.Println("Got new batch, processing")
-						processBatch(w, batch, &totalArticlesProcessed)
-						log.Println("Batch finished, collecting next batch; total processed now at", totalArticlesProcessed)
-						batch = nil
+			if testTitle == "" {
+				if fromDump {
+					// if we're part way through a candidate list built with the same rules, or we've
+					// already scanned this dump with these rules, there's no need to rescan
+					if resumeOffset(candidatesPath(), rulesHash) == 0 && !candidatesCurrent(config.PathToDump, candidatesPath(), rulesHash) {
+						log.Println("Scanning dump for candidates")
+						scanDump(config.PathToDump, candidatesPath(), regexes)
+						recordDumpScan(config.PathToDump, candidatesPath(), rulesHash)
 					}
-				}
-
-				// if there was something left in the batch, but we didn't reach 500, process it now we're done
-				if len(batch) > 0 {
-					log.Println("Processing final batch")
-					processBatch(w, batch, &totalArticlesProcessed)
-					log.Println("Final batch complete; processed", totalArticlesProcessed, "pages")
-					batch = nil
+					processTitlesFile(w, candidatesPath(), rulesHash)
+				} else {
+					processTitlesFile(w, config.PathToArticles, rulesHash)
 				}
 			} else {
-				content, revTS, curTS, err := ybtools.FetchWikitextFromTitleWithTimestamps(testTitle)
+				content, revTS, curTS, missing, err := fetchPage(w, testTitle)
 				if err != nil {
 					log.Fatalln("Failed to fetch", testTitle, "with error", err)
 				}
+				if missing {
+					log.Fatalln("Test page", testTitle, "doesn't exist")
+				}
 				processArticle(w, testTitle, content, revTS, curTS, regexes, true, 0)
 			}
 
@@ -133,16 +123,84 @@ func main() {
 	}
 }
 
+// processTitlesFile processes every title in the gzipped list of titles at path,
+// which should have a header line before the titles (as the titles dump does).
+// Progress is checkpointed after every batch, so it can be picked up again with -resume.
+func processTitlesFile(w *mwclient.Client, path, rulesHash string) {
+	file, err := os.Open(path)
+	if err != nil {
+		ybtools.PanicErr("Failed to open titles file ", path, " with error ", err)
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		ybtools.PanicErr("Failed to create gzip reader with error ", err)
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+
+	// Ignore the first line; it's a header, page_title
+	scanner.Scan()
+
+	// at the point at which Wikipedia has more articles than can fit in a uint64, well, this will be fairly obsolete anyway >:)
+	totalArticlesProcessed := resumeOffset(path, rulesHash)
+	if totalArticlesProcessed == 0 {
+		// we're starting a new run from the top, rather than picking one up again
+		startRun()
+	}
+
+	for skipped := uint64(0); skipped < totalArticlesProcessed && scanner.Scan(); skipped++ {
+		// skip over everything we've already done
+	}
+
+	var batch []string
+	for scanner.Scan() {
+		// append our new title to our batch
+		batch = append(batch, scanner.Text())
+		if len(batch) == batchLimit {
+			log.Println("Got new batch, processing")
+			processBatch(w, batch, &totalArticlesProcessed)
+			saveCheckpoint(path, totalArticlesProcessed, rulesHash)
+			metrics.setTitlePosition(totalArticlesProcessed)
+			log.Println("Batch finished, collecting next batch; total processed now at", totalArticlesProcessed)
+			batch = nil
+		}
+	}
+
+	// if there was something left in the batch, but we didn't reach 500, process it now we're done
+	if len(batch) > 0 {
+		log.Println("Processing final batch")
+		processBatch(w, batch, &totalArticlesProcessed)
+		metrics.setTitlePosition(totalArticlesProcessed)
+		log.Println("Final batch complete; processed", totalArticlesProcessed, "pages")
+		batch = nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		ybtools.PanicErr("Failed to read titles file ", path, " with error ", err)
+	}
+
+	// we're all the way through, so the next run should start from the top
+	clearCheckpoint()
+}
+
 func processBatch(w *mwclient.Client, batch []string, totalArticlesProcessed *uint64) {
-	ybtools.ForPageInQuery(params.Values{
-		"action":       "query",
-		"titles":       strings.Join(batch, "|"),
-		"prop":         "revisions",
-		"curtimestamp": "1",
-		"rvprop":       "timestamp|content",
-		"rvslots":      "main",
-	}, func(title, text, revTS, curTS string) {
-		processArticle(w, title, text, revTS, curTS, regexes, false, 0)
-	})
-	*totalArticlesProcessed += 500
+	defer metrics.batchDone(time.Now())
+
+	// excluded titles aren't even fetched
+	var pages []fetchedPage
+	if titles := exclusions.filter(batch); len(titles) > 0 {
+		pages = fetchBatch(w, titles)
+	}
+
+	// Matching is done in parallel, but edits are all made from here, one at a time.
+	// This also means any panics from editing happen on the main goroutine, so our
+	// defers still get run.
+	for _, match := range matchPages(pages, regexes) {
+		editArticle(w, match, regexes, false, 0)
+	}
+	flushProtectedReport(w)
+	*totalArticlesProcessed += uint64(len(batch))
 }
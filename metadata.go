@@ -0,0 +1,127 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Not one of the scopes rules can use; it masks out just comments, nowiki and the
+// like, leaving the wikitext that actually does something
+const maskScopeUncommented string = "uncommented"
+
+var refTagRegex = regexp.MustCompile(`(?i)<ref\b[^<>]*?/?>`)
+var wikilinkRegex = regexp.MustCompile(`\[\[(:?)\s*([^\[\]|]*)`)
+
+// The language codes of the Wikipedias; a link starting with one of these and a colon is
+// an interlanguage link, as long as there's a title after the colon
+var interlanguagePrefixes = []string{
+	"aa", "ab", "ace", "ady", "af", "ak", "als", "alt", "am", "ami", "an", "ang", "anp", "ar", "arc",
+	"ary", "arz", "as", "ast", "atj", "av", "avk", "awa", "ay", "az", "azb", "ba", "ban", "bar",
+	"bat-smg", "bbc", "bcl", "bdr", "be", "be-tarask", "be-x-old", "bew", "bg", "bh", "bi", "bjn",
+	"blk", "bm", "bn", "bo", "bpy", "br", "bs", "btm", "bug", "bxr", "ca", "cbk-zam", "cdo", "ce",
+	"ceb", "ch", "cho", "chr", "chy", "ckb", "co", "cr", "crh", "cs", "csb", "cu", "cv", "cy", "da",
+	"dag", "de", "dga", "din", "diq", "dsb", "dtp", "dty", "dv", "dz", "ee", "el", "eml", "en", "eo",
+	"es", "et", "eu", "ext", "fa", "fat", "ff", "fi", "fiu-vro", "fj", "fo", "fon", "fr", "frp",
+	"frr", "fur", "fy", "ga", "gag", "gan", "gcr", "gd", "gl", "glk", "gn", "gom", "gor", "got",
+	"gpe", "gu", "guc", "gur", "guw", "gv", "ha", "hak", "haw", "he", "hi", "hif", "ho", "hr", "hsb",
+	"ht", "hu", "hy", "hyw", "hz", "ia", "iba", "id", "ie", "ig", "igl", "ii", "ik", "ilo", "inh",
+	"io", "is", "it", "iu", "ja", "jam", "jbo", "jv", "ka", "kaa", "kab", "kbd", "kbp", "kcg", "kg",
+	"kge", "ki", "kj", "kk", "kl", "km", "kn", "knc", "ko", "koi", "kr", "krc", "ks", "ksh", "ku",
+	"kus", "kv", "kw", "ky", "la", "lad", "lb", "lbe", "lez", "lfn", "lg", "li", "lij", "lld", "lmo",
+	"ln", "lo", "lrc", "lt", "ltg", "lv", "mad", "mai", "map-bms", "mdf", "mg", "mh", "mhr", "mi",
+	"min", "mk", "ml", "mn", "mni", "mnw", "mos", "mr", "mrj", "ms", "mt", "mus", "mwl", "my", "myv",
+	"mzn", "na", "nah", "nan", "nap", "nds", "nds-nl", "ne", "new", "ng", "nia", "nl", "nn", "no",
+	"nov", "nqo", "nr", "nrm", "nso", "nup", "nv", "ny", "oc", "olo", "om", "or", "os", "pa", "pag",
+	"pam", "pap", "pcd", "pcm", "pdc", "pfl", "pi", "pih", "pl", "pms", "pnb", "pnt", "ps", "pt",
+	"pwn", "qu", "rm", "rmy", "rn", "ro", "roa-rup", "roa-tara", "rsk", "ru", "rue", "rup", "rw",
+	"sa", "sah", "sat", "sc", "scn", "sco", "sd", "se", "sg", "sgs", "sh", "shi", "shn", "si",
+	"simple", "sk", "skr", "sl", "sm", "smn", "sn", "so", "sq", "sr", "srn", "ss", "st", "stq", "su",
+	"sv", "sw", "syl", "szl", "szy", "ta", "tay", "tcy", "tdd", "te", "tet", "tg", "th", "ti", "tig",
+	"tk", "tl", "tly", "tn", "to", "tok", "tpi", "tr", "trv", "ts", "tt", "tum", "tw", "ty", "tyv",
+	"udm", "ug", "uk", "ur", "uz", "ve", "vec", "vep", "vi", "vls", "vo", "vro", "wa", "war", "wo",
+	"wuu", "xal", "xh", "xmf", "yi", "yo", "yue", "za", "zea", "zgh", "zh", "zh-classical",
+	"zh-min-nan", "zh-yue", "zu",
+}
+
+// Links to these aren't links to other pages, they do something else entirely
+var notLinkRegex = regexp.MustCompile(`(?i)^(?:category|file|image|` + strings.Join(interlanguagePrefixes, "|") + `)\s*:\s*[^\s\]|]`)
+
+// masked returns the page's text masked to scope, reusing the page's masker if it has one
+func (page fetchedPage) masked(scope string) string {
+	if page.masker == nil {
+		return newTextMasker(page.text).mask(scope)
+	}
+	return page.masker.mask(scope)
+}
+
+func pageBytes(page fetchedPage) (int64, bool) {
+	return int64(len(page.text)), true
+}
+
+func pageWords(page fetchedPage) (int64, bool) {
+	prose := strings.ReplaceAll(page.masked(matchScopeProse), string(maskByte), " ")
+	return int64(len(strings.Fields(prose))), true
+}
+
+func pageRefs(page fetchedPage) (int64, bool) {
+	return int64(len(refTagRegex.FindAllStringIndex(page.masked(maskScopeUncommented), -1))), true
+}
+
+func pageLinks(page fetchedPage) (int64, bool) {
+	var links int64
+	for _, link := range wikilinkRegex.FindAllStringSubmatch(page.masked(maskScopeUncommented), -1) {
+		// a leading colon makes categories and files into ordinary links
+		if link[1] == ":" || !notLinkRegex.MatchString(link[2]) {
+			links++
+		}
+	}
+	return links, true
+}
+
+func pageSections(page fetchedPage) (int64, bool) {
+	return int64(len(headingRegex.FindAllStringIndex(page.masked(maskScopeUncommented), -1))), true
+}
+
+// pageAgeDays needs an extra request to find out when the page was created, as that can't
+// be fetched for a whole batch at once, so it's unknown until editArticle sets page.created.
+func pageAgeDays(page fetchedPage) (int64, bool) {
+	if page.created == nil {
+		return 0, false
+	}
+	created, ok := page.created()
+	if !ok {
+		return 0, false
+	}
+	return daysSince(created), true
+}
+
+func pageDaysSinceEdit(page fetchedPage) (int64, bool) {
+	edited, err := time.Parse(time.RFC3339, page.revTS)
+	if err != nil {
+		return 0, false
+	}
+	return daysSince(edited), true
+}
+
+func daysSince(t time.Time) int64 {
+	return int64(time.Since(t) / (24 * time.Hour))
+}
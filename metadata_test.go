@@ -0,0 +1,147 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const metadataTestArticle string = `{{Infobox thing|name=Thing}}
+A [[thing]] is a [[Other thing|thing]].<ref>{{cite web|title=Things}}</ref> <!-- [[Hidden]] <ref>x</ref> -->
+== History ==
+Things [[:Category:Things|happened]].<ref name="a" />
+=== Early ===
+Early things.
+[[File:Thing.jpg]]
+[[Category:Things]]
+[[de:Ding]]`
+
+func TestLinksWithColons(t *testing.T) {
+	page := fetchedPage{text: "See [[WP:N]], [[Man: A Story]], [[fr:Truc]], [[Foo]] and [[fr:]]."}
+	if got, _ := pageLinks(page); got != 4 {
+		t.Errorf("pageLinks gave %d, want 4", got)
+	}
+	// only the interlanguage link is masked out of the prose
+	prose := page.masked(matchScopeProse)
+	if !strings.Contains(prose, "WP:N") || !strings.Contains(prose, "Man: A Story") || strings.Contains(prose, "Truc") {
+		t.Errorf("Prose scope gave %q, want only fr:Truc masked out", prose)
+	}
+}
+
+func TestMeasures(t *testing.T) {
+	page := fetchedPage{text: metadataTestArticle, revTS: time.Now().Add(-49 * time.Hour).Format(time.RFC3339)}
+	tests := []struct {
+		measure string
+		want    int64
+	}{
+		{"Bytes", int64(len(metadataTestArticle))},
+		{"Words", 10},
+		{"Refs", 2},
+		{"Links", 3},
+		{"Sections", 2},
+		{"DaysSinceEdit", 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.measure, func(t *testing.T) {
+			got, known := measures[test.measure].measure(page)
+			if !known || got != test.want {
+				t.Errorf("%s gave %d (known: %v), want %d", test.measure, got, known, test.want)
+			}
+		})
+	}
+
+	if _, known := measures["AgeDays"].measure(page); known {
+		t.Error("AgeDays was known for a page with no way of finding its creation date")
+	}
+}
+
+func TestUnknownConditions(t *testing.T) {
+	page := fetchedPage{text: "foo"}
+	tests := []struct {
+		condition string
+		holds     bool
+		known     bool
+	}{
+		{`{"minAgeDays": 5}`, false, false},
+		{`{"not": {"minAgeDays": 5}}`, true, false},
+		{`{"all": ["bar", {"minAgeDays": 5}]}`, false, true},
+		{`{"all": ["foo", {"minAgeDays": 5}]}`, true, false},
+		{`{"any": ["foo", {"minAgeDays": 5}]}`, true, true},
+		{`{"any": ["bar", {"minAgeDays": 5}]}`, false, false},
+	}
+
+	for _, test := range tests {
+		holds, known := mustParseCondition(t, test.condition).eval(page)
+		if known != test.known || (known && holds != test.holds) {
+			t.Errorf("%s gave %v (known: %v), want %v (known: %v)", test.condition, holds, known, test.holds, test.known)
+		}
+	}
+}
+
+func TestAgeConditions(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	// the fake wiki's pages were all created in 2020
+	config.RegexesJSONPageID = strconv.Itoa(fw.setPage("User:Yapperbot/Scantag.json", `{
+		"new claim": {
+			"detected": "a new claim",
+			"noTagIf": false,
+			"prefix": "{{New}}\n",
+			"conditions": {"maxAgeDays": 30}
+		},
+		"old claim": {
+			"detected": "an old claim",
+			"noTagIf": false,
+			"prefix": "{{Old}}\n",
+			"conditions": {"minAgeDays": 30}
+		}
+	}`))
+	loadRegexes(w)
+
+	fw.setPage("New", "This is a new claim.")
+	fw.setPage("Old", "This is an old claim.")
+
+	var processed uint64
+	processBatch(w, []string{"New", "Old"}, &processed)
+
+	if text := fw.text("New"); strings.HasPrefix(text, "{{New}}") {
+		t.Errorf("Page created in 2020 was tagged as new:\n%s", text)
+	}
+	if text := fw.text("Old"); !strings.HasPrefix(text, "{{Old}}") {
+		t.Errorf("Page created in 2020 wasn't tagged as old:\n%s", text)
+	}
+
+	// when scanning a dump there's no way to know, so the page should be a candidate
+	if matches, _ := matchArticle(fetchedPage{title: "New", text: "This is a new claim."}, regexes, false); len(matches) != 1 {
+		t.Errorf("Page of unknown age wasn't a candidate: %+v", matches)
+	}
+}
+
+func TestMatchArticleMasksOnce(t *testing.T) {
+	rule := STRegex{ID: "claim", Key: `claim`, Regex: regexp.MustCompile(`claim`), Prefix: "{{Tag}}\n", Detected: "a claim", MatchScope: matchScopeProse,
+		Conditions: mustParseCondition(t, `{"minWords": 2}`)}
+	matches, _ := matchArticle(fetchedPage{title: "Test", text: "A claim."}, map[string]STRegex{rule.ID: rule}, false)
+	if len(matches) != 1 {
+		t.Errorf("matchArticle gave %+v, want one match", matches)
+	}
+}
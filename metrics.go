@@ -0,0 +1,173 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+)
+
+// scantagMetrics holds the counters exposed on the metrics endpoint. They're
+// always kept up to date, but only served if MetricsListen is configured.
+type scantagMetrics struct {
+	sync.Mutex
+	pagesScanned  uint64
+	ruleMatches   map[string]uint64
+	edits         uint64
+	apiErrors     map[string]uint64
+	auditErrors   uint64
+	batchSeconds  float64
+	batches       uint64
+	titlePosition uint64
+}
+
+var metrics = scantagMetrics{
+	ruleMatches: map[string]uint64{},
+	apiErrors:   map[string]uint64{},
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// serveMetrics starts serving metrics in the Prometheus text format on
+// MetricsListen, if it's set. It returns straight away.
+func serveMetrics() {
+	if config.MetricsListen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(rw)
+	})
+
+	go func() {
+		// metrics are nice to have, but not worth stopping the bot over
+		log.Println("Serving metrics on", config.MetricsListen)
+		if err := http.ListenAndServe(config.MetricsListen, mux); err != nil {
+			log.Println("Metrics listener stopped with error", err)
+		}
+	}()
+}
+
+func (m *scantagMetrics) pageScanned(matches []ruleMatch) {
+	m.Lock()
+	defer m.Unlock()
+	m.pagesScanned++
+	for _, rmatch := range matches {
+		m.ruleMatches[rmatch.rule.ID]++
+	}
+}
+
+func (m *scantagMetrics) edited() {
+	m.Lock()
+	defer m.Unlock()
+	m.edits++
+}
+
+func (m *scantagMetrics) apiError(code string) {
+	m.Lock()
+	defer m.Unlock()
+	m.apiErrors[code]++
+}
+
+// apiCallFailed records an error returned by a call to the API, under its error code
+// if the API gave one, or as "other" if the request itself failed
+func (m *scantagMetrics) apiCallFailed(err error) {
+	if apierr, ok := err.(mwclient.APIError); ok {
+		m.apiError(apierr.Code)
+	} else {
+		m.apiError("other")
+	}
+}
+
+func (m *scantagMetrics) auditError() {
+	m.Lock()
+	defer m.Unlock()
+	m.auditErrors++
+}
+
+func (m *scantagMetrics) batchDone(started time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.batchSeconds += time.Since(started).Seconds()
+	m.batches++
+}
+
+func (m *scantagMetrics) setTitlePosition(position uint64) {
+	m.Lock()
+	defer m.Unlock()
+	m.titlePosition = position
+}
+
+// write writes out every metric in the Prometheus text exposition format
+func (m *scantagMetrics) write(out io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintln(out, "# HELP scantag_pages_scanned_total Pages that have had the rules run over them.")
+	fmt.Fprintln(out, "# TYPE scantag_pages_scanned_total counter")
+	fmt.Fprintln(out, "scantag_pages_scanned_total", m.pagesScanned)
+
+	fmt.Fprintln(out, "# HELP scantag_rule_matches_total Pages each rule has matched and wanted to tag.")
+	fmt.Fprintln(out, "# TYPE scantag_rule_matches_total counter")
+	writeLabelled(out, "scantag_rule_matches_total", "rule", m.ruleMatches)
+
+	fmt.Fprintln(out, "# HELP scantag_edits_total Edits successfully made.")
+	fmt.Fprintln(out, "# TYPE scantag_edits_total counter")
+	fmt.Fprintln(out, "scantag_edits_total", m.edits)
+
+	fmt.Fprintln(out, "# HELP scantag_api_errors_total API errors returned when editing, by error code.")
+	fmt.Fprintln(out, "# TYPE scantag_api_errors_total counter")
+	writeLabelled(out, "scantag_api_errors_total", "code", m.apiErrors)
+
+	fmt.Fprintln(out, "# HELP scantag_audit_errors_total Lines that couldn't be written to the audit log.")
+	fmt.Fprintln(out, "# TYPE scantag_audit_errors_total counter")
+	fmt.Fprintln(out, "scantag_audit_errors_total", m.auditErrors)
+
+	fmt.Fprintln(out, "# HELP scantag_batch_duration_seconds Time taken to fetch, match and edit each batch.")
+	fmt.Fprintln(out, "# TYPE scantag_batch_duration_seconds summary")
+	fmt.Fprintln(out, "scantag_batch_duration_seconds_sum", m.batchSeconds)
+	fmt.Fprintln(out, "scantag_batch_duration_seconds_count", m.batches)
+
+	fmt.Fprintln(out, "# HELP scantag_title_position Titles processed so far in the current titles file.")
+	fmt.Fprintln(out, "# TYPE scantag_title_position gauge")
+	fmt.Fprintln(out, "scantag_title_position", m.titlePosition)
+}
+
+// writeLabelled writes a metric with one label, in a stable order
+func writeLabelled(out io.Writer, name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(out, "%s{%s=\"%s\"} %d\n", name, label, metricsLabelEscaper.Replace(key), values[key])
+	}
+}
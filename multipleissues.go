@@ -0,0 +1,194 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Like startRegex, these follow Twinkle's handling of {{Multiple issues}}
+var multipleIssuesRegex = regexp.MustCompile(`(?i)\{\{\s*(?:multiple ?issues|article ?issues|mi)\s*\|`)
+
+// A template on a line of its own, allowing for templates nested one deep in its parameters
+var templateLineRegex = regexp.MustCompile(`^\{\{(?:[^{}]|\{\{[^{}]*\}\})*\}\}$`)
+
+// Templates that sit at the top of articles, among the maintenance tags, but aren't issues,
+// so don't go in the wrapper; they're moved above it
+var notIssueRegex = regexp.MustCompile(`(?i)^\{\{\s*(?:use [^|{}]*(?:dates|english)|engvar|italic title|lowercase title|DISPLAYTITLE\s*:|pp(?:-[^|{}]*)?\s*(?:\||\}\})|good article|featured article|coord|short description|multiple ?issues|article ?issues|mi\s*\|)`)
+
+// The cleanup templates that can go inside {{Multiple issues}}, after Twinkle's list and
+// the {{Multiple issues}} documentation, lowercased. Anything else at the top of an article,
+// like a sidebar, an infobox or a navbox, is left where it is.
+var issueTemplates = map[string]bool{}
+
+func init() {
+	for _, name := range []string{
+		"advert", "all plot", "autobiography", "blp sources", "blp unsourced", "blp primary sources",
+		"buzzword", "citation style", "cleanup", "cleanup ai", "cleanup bare urls", "cleanup lang",
+		"cleanup pr", "cleanup reorganize", "cleanup rewrite", "cleanup tense", "close paraphrasing",
+		"coi", "condense", "confusing", "context", "copy edit", "copypaste", "dead end", "disputed",
+		"essay-like", "expand language", "expert needed", "external links", "fanpov", "fansite",
+		"fiction", "globalize", "hoax", "howto", "improve categories", "in-universe",
+		"inappropriate person", "incomplete", "lead missing", "lead rewrite", "lead too long",
+		"lead too short", "like resume", "local", "manual", "mos", "more citations needed",
+		"more footnotes needed", "news release", "no footnotes", "non-free", "notability", "obituary",
+		"one source", "orphan", "original research", "over-coverage", "overlinked", "over-quotation",
+		"peacock", "plot", "pov", "primary sources", "prose", "recentism", "refimprove", "sections",
+		"self-published", "story", "synthesis", "technical", "third-party", "tone", "too few opinions",
+		"trivia", "underlinked", "undue weight", "unfocused", "unreferenced", "unreliable sources",
+		"update", "very long", "weasel", "worldwide view",
+	} {
+		issueTemplates[name] = true
+	}
+}
+
+// Matches the name of the template at the start of a template line
+var templateNameRegex = regexp.MustCompile(`^\{\{\s*([^|{}]*?)\s*(?:\||\}\})`)
+
+// templateName returns the normalised name of the template at the start of line
+func templateName(line string) string {
+	match := templateNameRegex.FindStringSubmatch(line)
+	if match == nil {
+		return ""
+	}
+	return strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(match[1], "_", " ")), " "))
+}
+
+// templateLines splits text into lines that are each a single template, returning
+// nil if there's anything in it other than templates and blank lines.
+func templateLines(text string) (templates []string) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !templateLineRegex.MatchString(line) {
+			return nil
+		}
+		templates = append(templates, line)
+	}
+	return
+}
+
+// isIssueTemplate returns whether a template line is a maintenance tag that could go
+// inside {{Multiple issues}}
+func isIssueTemplate(line string) bool {
+	return templateLineRegex.MatchString(line) && issueTemplates[templateName(line)]
+}
+
+// closingBraces returns the index of the }} that closes the template opened at start,
+// or -1 if it's never closed.
+func closingBraces(text string, start int) int {
+	depth := 0
+	for i := start; i < len(text)-1; i++ {
+		switch text[i : i+2] {
+		case "{{":
+			depth++
+			i++
+		case "}}":
+			depth--
+			if depth == 0 {
+				return i
+			}
+			i++
+		}
+	}
+	return -1
+}
+
+// insertIssueTags adds prepend to the top of text, as insertMaintenanceTemplate does,
+// except that if prepend is made up of maintenance tags they go inside the article's
+// {{Multiple issues}} if it has one, or inside a new one if that would take the number
+// of tags at the top of the article to MultipleIssuesThreshold.
+func insertIssueTags(text, prepend string) string {
+	tags := templateLines(prepend)
+	if tags == nil {
+		return insertMaintenanceTemplate(text, prepend)
+	}
+	for _, tag := range tags {
+		if !isIssueTemplate(tag) {
+			return insertMaintenanceTemplate(text, prepend)
+		}
+	}
+
+	// only a wrapper in the lead counts; ones further down are for their own sections
+	lead := text
+	if heading := headingRegex.FindStringIndex(text); heading != nil {
+		lead = text[:heading[0]]
+	}
+	if loc := multipleIssuesRegex.FindStringIndex(lead); loc != nil {
+		if end := closingBraces(text, loc[0]); end != -1 {
+			// put the new tags on their own lines, just before the wrapper's closing braces
+			inside := text[loc[1]:end]
+			var newline string
+			if !strings.HasSuffix(inside, "\n") {
+				newline = "\n"
+			}
+			return text[:end] + newline + strings.Join(tags, "\n") + "\n" + text[end:]
+		}
+	}
+
+	if config.MultipleIssuesThreshold <= 0 {
+		return insertMaintenanceTemplate(text, prepend)
+	}
+
+	// find the block of templates straight after the hatnotes and the like
+	blockStart := 0
+	if match := startRegex.FindStringIndex(text); match != nil {
+		blockStart = match[1]
+	}
+	var issues, others []string
+	blockEnd := blockStart
+	for blockEnd < len(text) {
+		lineEnd := strings.IndexByte(text[blockEnd:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(text) - blockEnd
+		}
+		line := strings.TrimSpace(text[blockEnd : blockEnd+lineEnd])
+		if isIssueTemplate(line) {
+			issues = append(issues, line)
+		} else if templateLineRegex.MatchString(line) && notIssueRegex.MatchString(line) {
+			others = append(others, line)
+		} else {
+			// anything else, including templates like sidebars, ends the block of tags
+			break
+		}
+		blockEnd += lineEnd
+		if blockEnd < len(text) {
+			// past the newline
+			blockEnd++
+		}
+	}
+
+	if len(issues)+len(tags) < config.MultipleIssuesThreshold {
+		return insertMaintenanceTemplate(text, prepend)
+	}
+
+	var builder strings.Builder
+	for _, other := range others {
+		builder.WriteString(other + "\n")
+	}
+	builder.WriteString("{{Multiple issues|\n")
+	for _, tag := range append(tags, issues...) {
+		builder.WriteString(tag + "\n")
+	}
+	builder.WriteString("}}\n")
+	return text[:blockStart] + builder.String() + text[blockEnd:]
+}
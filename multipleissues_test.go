@@ -0,0 +1,84 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import "testing"
+
+func TestInsertIssueTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		text      string
+		prepend   string
+		want      string
+	}{
+		{"existing wrapper", 0,
+			"{{About|the thing}}\n{{Multiple issues|\n{{Orphan|date=May 2020}}\n{{Refimprove|date=May 2020}}\n}}\nText.",
+			"{{Unreferenced|date=October 2026}}\n",
+			"{{About|the thing}}\n{{Multiple issues|\n{{Orphan|date=May 2020}}\n{{Refimprove|date=May 2020}}\n{{Unreferenced|date=October 2026}}\n}}\nText."},
+		{"existing one-line wrapper", 0,
+			"{{Multiple issues|{{Orphan}}{{Refimprove}}}}\nText.",
+			"{{Unreferenced}}\n",
+			"{{Multiple issues|{{Orphan}}{{Refimprove}}\n{{Unreferenced}}\n}}\nText."},
+		{"section wrapper ignored", 0,
+			"Text.\n== History ==\n{{Multiple issues|section=yes|\n{{Orphan}}\n}}",
+			"{{Unreferenced}}\n",
+			"{{Unreferenced}}\nText.\n== History ==\n{{Multiple issues|section=yes|\n{{Orphan}}\n}}"},
+		{"under threshold", 3,
+			"{{Short description|A thing}}\n{{Orphan|date=May 2020}}\nText.",
+			"{{Unreferenced}}\n",
+			"{{Short description|A thing}}\n{{Unreferenced}}\n{{Orphan|date=May 2020}}\nText."},
+		{"reaches threshold", 3,
+			"{{Short description|A thing}}\n{{Use dmy dates|date=May 2020}}\n{{Orphan|date=May 2020}}\n{{Refimprove|date=May 2020}}\nText.",
+			"{{Unreferenced|date=October 2026}}\n",
+			"{{Short description|A thing}}\n{{Use dmy dates|date=May 2020}}\n{{Multiple issues|\n{{Unreferenced|date=October 2026}}\n{{Orphan|date=May 2020}}\n{{Refimprove|date=May 2020}}\n}}\nText."},
+		{"threshold disabled", 0,
+			"{{Orphan}}\n{{Refimprove}}\nText.",
+			"{{Unreferenced}}\n",
+			"{{Unreferenced}}\n{{Orphan}}\n{{Refimprove}}\nText."},
+		{"sidebar after the tags left alone", 3,
+			"{{Orphan}}\n{{Refimprove}}\n{{Politics of Canada}}\nText.",
+			"{{Unreferenced}}\n",
+			"{{Multiple issues|\n{{Unreferenced}}\n{{Orphan}}\n{{Refimprove}}\n}}\n{{Politics of Canada}}\nText."},
+		{"sidebar before the tags left alone", 3,
+			"{{Politics of Canada}}\n{{Orphan}}\n{{Refimprove}}\nText.",
+			"{{Unreferenced}}\n",
+			"{{Unreferenced}}\n{{Politics of Canada}}\n{{Orphan}}\n{{Refimprove}}\nText."},
+		{"other templates don't count", 3,
+			"{{Infobox thing|name=Thing}}\n{{Authority control}}\n{{Orphan}}\nText.",
+			"{{Unreferenced}}\n",
+			"{{Unreferenced}}\n{{Infobox thing|name=Thing}}\n{{Authority control}}\n{{Orphan}}\nText."},
+		{"not a template", 0,
+			"{{Multiple issues|\n{{Orphan}}\n}}\nText.",
+			"Hello there\n",
+			"Hello there\n{{Multiple issues|\n{{Orphan}}\n}}\nText."},
+	}
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.MultipleIssuesThreshold = test.threshold
+			if got := insertIssueTags(test.text, test.prepend); got != test.want {
+				t.Errorf("insertIssueTags gave:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Entries in {{bots|deny=...}} starting with this opt a page out of a single rule,
+// leaving the rest of the bot (and the rest of Scantag) alone
+const optOutBotsPrefix string = "scantag-"
+
+// The templates and comments that editors can use to opt a page out of individual rules:
+// {{bots|deny=Scantag-<name>}}, or <!-- Scantag-deny: <name> -->. Both can list several
+// names, separated by commas.
+var optOutBotsRegex = regexp.MustCompile(`(?i)\{\{\s*bots\s*\|(?:[^{}]*\|)?\s*deny\s*=\s*([^|{}]*)`)
+var optOutCommentRegex = regexp.MustCompile(`(?i)<!--\s*Scantag-deny\s*:\s*(.*?)\s*-->`)
+
+// Opt-out names and rule IDs go in templates and comments, so they can't have anything that'd break those
+var ruleNameRegex = regexp.MustCompile(`^[\w-]+$`)
+
+// optOutTemplate is what an editor would add to opt a page out of a rule with the given name
+const optOutTemplate string = "{{bots|deny=Scantag-%s}}"
+
+// parseOptOut checks a rule's opt-out name, which is empty if the rule should use its ID
+func parseOptOut(name string) (string, error) {
+	if name != "" && !ruleNameRegex.MatchString(name) {
+		return "", fmt.Errorf("`%s` can only have letters, numbers, underscores and hyphens", name)
+	}
+	return name, nil
+}
+
+// optedOutRules returns the lowercased names of every rule that text opts out of
+func optedOutRules(text string) map[string]bool {
+	optedOut := map[string]bool{}
+	for _, match := range optOutBotsRegex.FindAllStringSubmatch(text, -1) {
+		for _, entry := range strings.Split(match[1], ",") {
+			entry = strings.ToLower(strings.TrimSpace(entry))
+			if strings.HasPrefix(entry, optOutBotsPrefix) {
+				optedOut[strings.TrimPrefix(entry, optOutBotsPrefix)] = true
+			}
+		}
+	}
+	for _, match := range optOutCommentRegex.FindAllStringSubmatch(text, -1) {
+		for _, entry := range strings.Split(match[1], ",") {
+			optedOut[strings.ToLower(strings.TrimSpace(entry))] = true
+		}
+	}
+	return optedOut
+}
+
+// optedOut returns whether rule is one of those in optedOut, as returned by optedOutRules
+func (rule STRegex) optedOut(optedOut map[string]bool) bool {
+	return rule.OptOut != "" && optedOut[strings.ToLower(rule.OptOut)]
+}
@@ -0,0 +1,75 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+func TestOptedOutRules(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"nothing", "Some text.", nil},
+		{"bots template", "{{bots|deny=Scantag-Unsourced}}\nSome text.", []string{"unsourced"}},
+		{"bots template with others", "{{bots|deny=SomeBot, Scantag-unsourced,Scantag-stub}}", []string{"unsourced", "stub"}},
+		{"bots template with other parameters", "{{Bots|optout=all|deny=Scantag-stub}}", []string{"stub"}},
+		{"comment", "Text <!-- Scantag-deny: unsourced, stub -->", []string{"unsourced", "stub"}},
+		{"other bots only", "{{bots|deny=SomeBot}}", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := optedOutRules(test.text)
+			if len(got) != len(test.want) {
+				t.Errorf("optedOutRules gave %v, want %v", got, test.want)
+			}
+			for _, name := range test.want {
+				if !got[name] {
+					t.Errorf("optedOutRules gave %v, which doesn't include %s", got, name)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchArticleOptOut(t *testing.T) {
+	regexes := map[string]STRegex{
+		"unsourced": {ID: "unsourced", Key: "unsourced claim", Regex: regexp.MustCompile(`(?i)unsourced claim`), Prefix: "{{Unreferenced}}\n", Detected: "an unsourced claim", OptOut: "unsourced"},
+		"stub":      {ID: "stub", Key: `\(stub\)`, Regex: regexp.MustCompile(`(?i)\(stub\)`), Suffix: "\n{{Stub}}", Detected: "a stub marker", OptOut: "stub"},
+	}
+
+	text := "{{bots|deny=Scantag-unsourced}}\nAn unsourced claim (stub)"
+	if !ybtools.BotAllowed(text) {
+		t.Fatal("A per-rule opt out stopped the whole bot")
+	}
+
+	matches, skipped := matchArticle(fetchedPage{title: "Test", text: text}, regexes, false)
+	if len(matches) != 1 || matches[0].rule.ID != "stub" {
+		t.Errorf("matchArticle gave %+v, want just the stub rule", matches)
+	}
+	if len(skipped) != 1 || skipped[0].rule.ID != "unsourced" || skipped[0].outcome != auditOptedOut {
+		t.Errorf("matchArticle skipped %+v, want the unsourced rule opted out", skipped)
+	}
+}
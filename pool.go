@@ -0,0 +1,86 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// fetchedPage is a page whose content has been retrieved, but not yet matched
+type fetchedPage struct {
+	title     string
+	namespace int
+	text      string
+	revTS     string
+	curTS     string
+
+	// haveCategories is false if we don't know what categories the page is in
+	categories     []string
+	haveCategories bool
+
+	// created lazily fetches when the page was created; it's nil until editArticle
+	// needs it, as it takes a request of its own
+	created func() (created time.Time, ok bool)
+	// masker is shared by everything matching against the page, so it's only tokenized once
+	masker *textMasker
+}
+
+// matchWorkers returns how many goroutines should be used to match pages
+func matchWorkers() int {
+	if config.MatchWorkers > 0 {
+		return config.MatchWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// matchPages runs the regexes over every page in pages, spread across a pool of
+// matchWorkers() goroutines. The matches are returned in the same order as pages,
+// so that edits made from them are made in a predictable order.
+func matchPages(pages []fetchedPage, regexes map[string]STRegex) []articleMatch {
+	results := make([]articleMatch, len(pages))
+	inPool(len(pages), func(i int) {
+		results[i] = matchPage(pages[i], regexes, false, false)
+	})
+	return results
+}
+
+// inPool calls work for every index from 0 to count-1, spread across a pool of
+// matchWorkers() goroutines, and returns once they've all been done.
+func inPool(count int, work func(i int)) {
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < matchWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				work(j)
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
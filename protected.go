@@ -0,0 +1,227 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+// The values ProtectedNotify can take
+const (
+	protectedNotifyTalk   string = "talk"
+	protectedNotifyReport string = "report"
+)
+
+// Each notice has a marker for every rule it's about, so that on later passes we
+// don't post about the same rule twice, but do post about rules that match later.
+const protectedTalkMarker string = `<!-- Scantag protected page notice: %s -->`
+const protectedTalkHeading string = `Maintenance tags from Scantag`
+const protectedTalkTemplate string = `%s
+[[User:Yapperbot/Scantag|Scantag]] detected %s on this article, but couldn't tag it because the article is protected. If you agree with the tagging, please consider adding the following to the article:
+<pre>%s</pre>
+~~~~`
+
+const protectedReportTemplate string = `* %s: detected %s; would have added <code><nowiki>%s</nowiki></code>
+`
+
+// protectedReportEntry is a protected article waiting to be added to the report page
+type protectedReportEntry struct {
+	link string
+	line string
+}
+
+// Entries waiting to be added to the report page, built up over a batch
+var protectedReportEntries []protectedReportEntry
+
+// notifyProtected handles a protected article that we wanted to tag, according to
+// ProtectedNotify: either posting to its talk page, or queueing it for the report page.
+// rules are the rules that would have tagged the article.
+func notifyProtected(w *mwclient.Client, title string, namespace int, rules []ruleMatch) {
+	switch config.ProtectedNotify {
+	case protectedNotifyTalk:
+		postProtectedTalkNotice(w, talkPageTitle(title, namespace), rules)
+	case protectedNotifyReport:
+		detectedBits, tags := protectedTags(rules)
+		link := pageLink(title, namespace)
+		protectedReportEntries = append(protectedReportEntries, protectedReportEntry{
+			link: link,
+			line: fmt.Sprintf(protectedReportTemplate, link, detectedBits, strings.TrimSpace(tags)),
+		})
+	}
+}
+
+// talkPageTitle returns the title of the talk page for title, which is in namespace
+func talkPageTitle(title string, namespace int) string {
+	if namespace == 0 {
+		return "Talk:" + title
+	}
+	if namespace%2 == 1 {
+		// already a talk page
+		return title
+	}
+	parts := strings.SplitN(title, ":", 2)
+	return parts[0] + " talk:" + parts[1]
+}
+
+// pageLink links to title, which is in namespace, without categorising the page the
+// link is on if title happens to be a category
+func pageLink(title string, namespace int) string {
+	if namespace == 0 {
+		return "[[" + title + "]]"
+	}
+	return "[[:" + title + "]]"
+}
+
+// protectedTags returns what rules detected, and the tags they would have added,
+// in the order editArticle would have added them
+func protectedTags(rules []ruleMatch) (detectedBits, tags string) {
+	var detected []string
+	var top, placed, suffixes strings.Builder
+	for _, rmatch := range rules {
+		detected = append(detected, rmatch.rule.Detected)
+		if rmatch.rule.Placement.kind == placementTop {
+			top.WriteString(rmatch.prefix)
+		} else {
+			placed.WriteString(rmatch.prefix)
+		}
+		suffixes.WriteString(rmatch.suffix)
+	}
+	return strings.Join(detected, "; "), top.String() + placed.String() + suffixes.String()
+}
+
+// postProtectedTalkNotice posts a notice to talkTitle about any of rules that
+// haven't already been posted about there
+func postProtectedTalkNotice(w *mwclient.Client, talkTitle string, rules []ruleMatch) {
+	talkText, _, _, _, err := fetchPage(w, talkTitle)
+	if err != nil {
+		log.Println("Failed to fetch", talkTitle, "to post protected page notice, so skipping it. Error was", err)
+		return
+	}
+
+	if !ybtools.BotAllowed(talkText) {
+		log.Println("Not posting protected page notice to", talkTitle, "as it excludes bots")
+		return
+	}
+	var unnoticed []ruleMatch
+	var markers []string
+	for _, rmatch := range rules {
+		marker := fmt.Sprintf(protectedTalkMarker, rmatch.rule.ID)
+		if !strings.Contains(talkText, marker) {
+			unnoticed = append(unnoticed, rmatch)
+			markers = append(markers, marker)
+		}
+	}
+	if len(unnoticed) == 0 {
+		// we've already told them about all of it
+		return
+	}
+	detectedBits, tags := protectedTags(unnoticed)
+
+	if !canEdit() {
+		ybtools.PanicErr("Edit limited out, stopping")
+	}
+
+	err = w.Edit(params.Values{
+		"title":        talkTitle,
+		"section":      "new",
+		"sectiontitle": protectedTalkHeading,
+		"summary":      "[[User:Yapperbot/Scantag|Scantag]]: article is protected, suggesting maintenance tags",
+		"bot":          "true",
+		"text":         fmt.Sprintf(protectedTalkTemplate, strings.Join(markers, "\n"), detectedBits, tags),
+	})
+	if err != nil {
+		metrics.apiCallFailed(err)
+		if apierr, ok := err.(mwclient.APIError); ok {
+			switch apierr.Code {
+			case "noedit", "writeapidenied", "blocked":
+				ybtools.PanicErr("noedit/writeapidenied/blocked code returned, the bot may have been blocked. Dying")
+			}
+		}
+		log.Println("Failed to post protected page notice to", talkTitle, "with error", err)
+		return
+	}
+	log.Println("Posted protected page notice to", talkTitle)
+	time.Sleep(editDelay)
+}
+
+// flushProtectedReport adds any queued protected articles to the report page,
+// leaving out any that are already listed there. If the report can't be saved,
+// the entries stay queued, to be tried again after the next batch.
+func flushProtectedReport(w *mwclient.Client) {
+	if len(protectedReportEntries) == 0 {
+		return
+	}
+
+	reportText, revTS, curTS, _, err := fetchPageByID(w, config.ProtectedReportPageID)
+	if err != nil {
+		log.Println("Failed to fetch protected page report, will try again after the next batch. Error was", err)
+		return
+	}
+
+	var newLines strings.Builder
+	for _, entry := range protectedReportEntries {
+		if !strings.Contains(reportText, entry.link) && !strings.Contains(newLines.String(), entry.link) {
+			newLines.WriteString(entry.line)
+		}
+	}
+
+	if newLines.Len() == 0 {
+		protectedReportEntries = nil
+		return
+	}
+
+	if reportText != "" && !strings.HasSuffix(reportText, "\n") {
+		reportText += "\n"
+	}
+
+	if !canEdit() {
+		ybtools.PanicErr("Edit limited out, stopping")
+	}
+
+	err = w.Edit(params.Values{
+		"pageid":         config.ProtectedReportPageID,
+		"summary":        "[[User:Yapperbot/Scantag|Scantag]]: updating list of protected articles that need tagging",
+		"bot":            "true",
+		"basetimestamp":  revTS,
+		"starttimestamp": curTS,
+		"text":           reportText + newLines.String(),
+	})
+	if err != nil {
+		metrics.apiCallFailed(err)
+		if apierr, ok := err.(mwclient.APIError); ok {
+			switch apierr.Code {
+			case "noedit", "writeapidenied", "blocked":
+				ybtools.PanicErr("noedit/writeapidenied/blocked code returned, the bot may have been blocked. Dying")
+			}
+		}
+		// this includes edit conflicts; the report will be fetched again next time
+		log.Println("Failed to update protected page report, will try again after the next batch. Error was", err)
+		return
+	}
+	protectedReportEntries = nil
+	log.Println("Updated protected page report")
+	time.Sleep(editDelay)
+}
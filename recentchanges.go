@@ -0,0 +1,159 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+const defaultRecentChangesStatePath string = "scantag.rccontinue"
+const defaultRecentChangesInterval int = 120
+
+// MediaWiki's own timestamp format, which is what rccontinue uses
+const mwTimestampFormat string = "20060102150405"
+
+func recentChangesStatePath() string {
+	if config.RecentChangesStatePath == "" {
+		return defaultRecentChangesStatePath
+	}
+	return config.RecentChangesStatePath
+}
+
+// recentChangesInterval returns how long to wait between polls of recent changes
+func recentChangesInterval() time.Duration {
+	if config.RecentChangesInterval > 0 {
+		return time.Duration(config.RecentChangesInterval) * time.Second
+	}
+	return time.Duration(defaultRecentChangesInterval) * time.Second
+}
+
+// processRecentChanges processes every page in a namespace the rules apply to that has been created or edited
+// since we last checked, and then saves our place so that a restart doesn't miss anything.
+func processRecentChanges(w *mwclient.Client) {
+	token := loadRecentChangesToken()
+	titles, nextToken := fetchRecentChanges(w, token)
+	log.Println("Found", len(titles), "changed pages in recent changes")
+
+	var totalArticlesProcessed uint64
+	for len(titles) > 0 {
+		batchSize := batchLimit
+		if len(titles) < batchSize {
+			batchSize = len(titles)
+		}
+		processBatch(w, titles[:batchSize], &totalArticlesProcessed)
+		titles = titles[batchSize:]
+	}
+
+	// only save once everything's processed, so that if we die we'll pick the changes up again
+	saveRecentChangesToken(nextToken)
+}
+
+// fetchRecentChanges returns the unique titles of pages the rules might apply to created or edited since
+// token, along with the token to carry on from next time. An empty token means we've
+// never run before, in which case we start from now rather than going through
+// the entire recent changes table.
+func fetchRecentChanges(w *mwclient.Client, token string) (titles []string, nextToken string) {
+	if token == "" {
+		log.Println("No recent changes continuation token saved, starting from now")
+		return nil, time.Now().UTC().Format(mwTimestampFormat) + "|0"
+	}
+
+	nextToken = token
+	seen := map[string]bool{}
+	query := params.Values{
+		"action":        "query",
+		"list":          "recentchanges",
+		"rcnamespace":   namespaceList(ruleNamespaces(regexes)),
+		"rctype":        "new|edit",
+		"rcprop":        "title|timestamp|ids",
+		"rcdir":         "newer",
+		"rclimit":       "max",
+		"rcexcludeuser": botUser,
+		"rccontinue":    token,
+	}
+
+	for {
+		resp, err := w.Get(query)
+		if err != nil {
+			metrics.apiCallFailed(err)
+			ybtools.PanicErr("Failed to fetch recent changes with error ", err)
+		}
+
+		changes, err := ybtools.GetThingFromQuery(resp, "recentchanges")
+		if err != nil {
+			ybtools.PanicErr("Failed to get recent changes from query with error ", err)
+		}
+
+		for _, change := range changes {
+			title, err := change.GetString("title")
+			if err != nil {
+				log.Println("Failed to get title from recent change, so skipping it. Error was", err)
+				continue
+			}
+			timestamp, tsErr := change.GetString("timestamp")
+			rcid, idErr := change.GetInt64("rcid")
+			if tsErr != nil || idErr != nil {
+				log.Println("Failed to get timestamp or rcid from recent change to", title, "so skipping it")
+				continue
+			}
+
+			parsedTS, err := time.Parse(time.RFC3339, timestamp)
+			if err != nil {
+				log.Println("Recent change to", title, "had invalid timestamp", timestamp, "so skipping it")
+				continue
+			}
+			// carry on from the change after this one next time
+			nextToken = fmt.Sprintf("%s|%d", parsedTS.Format(mwTimestampFormat), rcid+1)
+
+			if !seen[title] {
+				seen[title] = true
+				titles = append(titles, title)
+			}
+		}
+
+		rccontinue, err := resp.GetString("continue", "rccontinue")
+		if err != nil {
+			// no more changes to go through
+			return
+		}
+		query.Set("rccontinue", rccontinue)
+	}
+}
+
+func loadRecentChangesToken() string {
+	token, err := ioutil.ReadFile(recentChangesStatePath())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(token))
+}
+
+func saveRecentChangesToken(token string) {
+	if err := writeFileAtomic(recentChangesStatePath(), []byte(token)); err != nil {
+		ybtools.PanicErr("Failed to write recent changes token with error ", err)
+	}
+}
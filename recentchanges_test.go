@@ -0,0 +1,79 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessRecentChanges(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	config.RecentChangesStatePath = filepath.Join(filepath.Dir(config.RuleCountsPath), "rccontinue")
+
+	// the first run has nothing to go on, so it just starts from now
+	fw.setPage("Before", "This is an unsourced claim.")
+	processRecentChanges(w)
+	if len(fw.edits) != 0 {
+		t.Fatalf("First run processed changes from before it started:\n%s", fw.transcript())
+	}
+	if token := loadRecentChangesToken(); !strings.HasSuffix(token, "|0") {
+		t.Fatalf("First run saved token %q, want the current time", token)
+	}
+
+	// pretend the first run was at the start of the fake wiki's clock, so that it sees the
+	// changes below, and make the changes come back a couple at a time to test paging
+	saveRecentChangesToken(fakeWikiEpoch.Format(mwTimestampFormat) + "|0")
+	fw.recentChangesLimit = 2
+	fw.setPage("Before", "Nothing to see here.")
+	fw.setPage("One", "This is an unsourced claim.")
+	fw.setPage("Two", "Nothing to see here.")
+	fw.setPage("Two", "Nothing to see here, apart from an unsourced claim.")
+	fw.setPage("Talk:Three", "This is an unsourced claim.")
+	fw.setPage("Four", "A short article (stub)")
+	last := fw.changes[len(fw.changes)-1]
+	lastTS, _ := time.Parse(time.RFC3339, last.timestamp)
+	wantToken := fmt.Sprintf("%s|%d", lastTS.Format(mwTimestampFormat), last.rcid+1)
+
+	processRecentChanges(w)
+
+	var edited []string
+	for _, edit := range fw.edits {
+		edited = append(edited, edit.title)
+	}
+	if got := strings.Join(edited, ", "); got != "One, Two, Four" {
+		t.Errorf("Recent changes edited %s, want One, Two, Four", got)
+	}
+	if token := loadRecentChangesToken(); token != wantToken {
+		t.Errorf("Saved token %q, want %q", token, wantToken)
+	}
+
+	// our own edits don't count as changes, so there's nothing more to do
+	edits := len(fw.edits)
+	processRecentChanges(w)
+	if len(fw.edits) != edits {
+		t.Errorf("Recent changes picked up the bot's own edits:\n%s", fw.transcript())
+	}
+	if token := loadRecentChangesToken(); token != wantToken {
+		t.Errorf("Token moved to %q with no new changes, want %q", token, wantToken)
+	}
+}
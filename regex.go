@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"log"
 	"regexp"
+	"sort"
+	"strings"
 
+	"cgt.name/pkg/go-mwclient"
 	"github.com/antonholmquist/jason"
+	"github.com/mashedkeyboard/ybtools/v2"
 )
 
 //
@@ -25,8 +31,16 @@ import (
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
+// How many hex digits of the regex's hash to use as the ID of a rule that doesn't have one
+const ruleIDHashLength int = 12
+
 // STRegex objects represent individual regexes being used by Scantag.
 type STRegex struct {
+	// ID identifies the rule everywhere other than Scantag.json, so that it stays the
+	// same if the regex is changed; Key is the regex as it's written in Scantag.json.
+	ID       string
+	Key      string
+	Regex    *regexp.Regexp
 	Task     string
 	Example  string
 	NoTagIf  *regexp.Regexp
@@ -34,9 +48,55 @@ type STRegex struct {
 	Prefix   string
 	Suffix   string
 	Detected string
+
+	Placement tagPlacement
+	// which pages the rule applies to, from onlyInCategory, notInCategory, titleMatches and namespaces
+	PageScope ruleScope
+	// which parts of a page the regex is run over, from scope
+	MatchScope string
+	// the name editors use to opt pages out of the rule
+	OptOut string
+	// nil if the rule has no conditions
+	Conditions condition
+
+	// Zero means there's no cap
+	MaxEditsPerDay int64
+	MaxEditsPerRun int64
+
+	// rules with a higher priority are run, and have their tags added, first
+	Priority int64
+	// only the highest priority rule to match in a group applies; empty if the rule isn't in one
+	Group string
 }
 
-func processRegex(regex string, content *jason.Value) (expr *regexp.Regexp, strgx STRegex, testpage string, err error) {
+// loadRegexes replaces the regexes in use with those from RegexesJSONPageID, returning
+// a hash of the rule set so that we can tell if it's changed since a checkpoint.
+func loadRegexes(w *mwclient.Client) string {
+	regexesJSON := loadJSONFromPageID(w, config.RegexesJSONPageID)
+
+	// start from scratch, or we'll keep the old versions of every rule around too
+	regexes = map[string]STRegex{}
+	for regex, content := range regexesJSON.Map() {
+		stregex, _, err := processRegex(regex, content)
+		if err != nil {
+			ybtools.PanicErr(err)
+		}
+		if existing, ok := regexes[stregex.ID]; ok {
+			ybtools.PanicErr("Regexes `", existing.Key, "` and `", regex, "` both have the ID ", stregex.ID)
+		}
+		regexes[stregex.ID] = stregex
+		log.Println("Found regex", stregex.ID+":", regex)
+	}
+
+	// encoding/json sorts map keys, so this is stable for the same rule set
+	rulesJSON, err := regexesJSON.MarshalJSON()
+	if err != nil {
+		ybtools.PanicErr("Failed to serialise regexes for hashing with error ", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(rulesJSON))
+}
+
+func processRegex(regex string, content *jason.Value) (strgx STRegex, testpage string, err error) {
 	value, err := content.Object()
 	if err != nil {
 		err = fmt.Errorf("Scantag.json key `%s` is invalid! Error was %s", regex, err)
@@ -75,13 +135,92 @@ func processRegex(regex string, content *jason.Value) (expr *regexp.Regexp, strg
 	}
 
 	prefix, _ := value.GetString("prefix")
+	if err = checkVariables(prefix, expression); err != nil {
+		err = fmt.Errorf("Prefix for `%s` is invalid! Error was %s", regex, err)
+		return
+	}
 	suffix, _ := value.GetString("suffix")
+	if err = checkVariables(suffix, expression); err != nil {
+		err = fmt.Errorf("Suffix for `%s` is invalid! Error was %s", regex, err)
+		return
+	}
+
+	placementString, _ := value.GetString("placement")
+	placement, err := parsePlacement(placementString)
+	if err != nil {
+		err = fmt.Errorf("Placement for `%s` is invalid! Error was %s", regex, err)
+		return
+	}
+
+	pageScope, err := parseScope(value)
+	if err != nil {
+		err = fmt.Errorf("Categories, titleMatches or namespaces for `%s` are invalid! Error was %s", regex, err)
+		return
+	}
+
+	matchScopeString, _ := value.GetString("scope")
+	matchScope, err := parseMatchScope(matchScopeString)
+	if err != nil {
+		err = fmt.Errorf("Match scope (the scope field) for `%s` is invalid! Error was %s", regex, err)
+		return
+	}
+
+	idString, _ := value.GetString("id")
+	id, err := parseRuleID(idString, regex)
+	if err != nil {
+		err = fmt.Errorf("ID for `%s` is invalid! Error was %s", regex, err)
+		return
+	}
+
+	optOutString, _ := value.GetString("optOut")
+	optOut, err := parseOptOut(optOutString)
+	if err != nil {
+		err = fmt.Errorf("optOut for `%s` is invalid! Error was %s", regex, err)
+		return
+	}
+	if optOut == "" {
+		optOut = id
+	}
+
+	var conditions condition
+	if conditionsValue, missingErr := value.GetValue("conditions"); missingErr == nil {
+		conditions, err = parseCondition(conditionsValue)
+		if err != nil {
+			err = fmt.Errorf("Conditions for `%s` are invalid! Error was %s", regex, err)
+			return
+		}
+	}
 
 	task, _ := value.GetString("task")
 	example, _ := value.GetString("example")
 	testpage, _ = value.GetString("testpage")
 
-	return expression, STRegex{
+	maxEditsPerDay, err := optionalCap(value, "maxEditsPerDay")
+	if err != nil {
+		err = fmt.Errorf("maxEditsPerDay for `%s` is invalid! Error was %s", regex, err)
+		return
+	}
+	maxEditsPerRun, err := optionalCap(value, "maxEditsPerRun")
+	if err != nil {
+		err = fmt.Errorf("maxEditsPerRun for `%s` is invalid! Error was %s", regex, err)
+		return
+	}
+
+	group, _ := value.GetString("group")
+
+	var priority int64
+	if _, missingErr := value.GetValue("priority"); missingErr == nil {
+		priority, err = value.GetInt64("priority")
+		if err != nil {
+			err = fmt.Errorf("Priority for `%s` is invalid! Error was %s", regex, err)
+			return
+		}
+	}
+
+	return STRegex{
+		ID:       id,
+		Key:      regex,
+		Regex:    expression,
 		Task:     task,
 		Example:  example,
 		Detected: detected,
@@ -89,19 +228,109 @@ func processRegex(regex string, content *jason.Value) (expr *regexp.Regexp, strg
 		Suffix:   suffix,
 		NoTagIf:  ntiexp,
 		UseNTI:   useNTI,
+
+		Placement:  placement,
+		PageScope:  pageScope,
+		MatchScope: matchScope,
+		OptOut:     optOut,
+		Conditions: conditions,
+
+		MaxEditsPerDay: maxEditsPerDay,
+		MaxEditsPerRun: maxEditsPerRun,
+
+		Priority: priority,
+		Group:    group,
 	}, testpage, nil
 }
 
+// ruleBefore returns whether a should be run before b: rules with a higher priority
+// go first, and rules with the same priority go in order of their IDs.
+func ruleBefore(a, b STRegex) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.ID < b.ID
+}
+
+// sortedRules returns the rules in regexes in the order they should be run in, so
+// that tags and edit summaries come out the same way every time.
+func sortedRules(regexes map[string]STRegex) []STRegex {
+	rules := make([]STRegex, 0, len(regexes))
+	for _, rule := range regexes {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return ruleBefore(rules[i], rules[j])
+	})
+	return rules
+}
+
+// parseRuleID checks a rule's ID, falling back to a hash of its regex if it doesn't have one.
+// IDs go in opt-out templates, so they're limited in the same way as opt-out names are.
+func parseRuleID(id, regex string) (string, error) {
+	if id == "" {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(regex)))[:ruleIDHashLength], nil
+	}
+	if !ruleNameRegex.MatchString(id) {
+		return "", fmt.Errorf("`%s` can only have letters, numbers, underscores and hyphens", id)
+	}
+	return id, nil
+}
+
+// parsePlacement parses a rule's placement, which is one of "top" (or empty),
+// "section:<regex on heading>" or "before:<regex on heading>".
+func parsePlacement(placement string) (tagPlacement, error) {
+	if placement == "" || placement == placementTop {
+		return tagPlacement{kind: placementTop, raw: placement}, nil
+	}
+
+	parts := strings.SplitN(placement, ":", 2)
+	if len(parts) != 2 || (parts[0] != placementSection && parts[0] != placementBefore) {
+		return tagPlacement{}, fmt.Errorf("`%s` isn't top, section:<heading> or before:<heading>", placement)
+	}
+
+	heading, err := regexp.Compile("(?i)" + parts[1])
+	if err != nil {
+		return tagPlacement{}, err
+	}
+	return tagPlacement{kind: parts[0], heading: heading, raw: placement}, nil
+}
+
+// optionalCap gets an edit cap from a rule, returning zero (no cap) if it isn't set
+func optionalCap(value *jason.Object, key string) (int64, error) {
+	if _, err := value.GetValue(key); err != nil {
+		return 0, nil
+	}
+	limit, err := value.GetInt64(key)
+	if err == nil && limit < 0 {
+		err = fmt.Errorf("cap must not be negative")
+	}
+	return limit, err
+}
+
 /* The JSON file containing regexes is expected to be of this format:
 
 {
     "Regex to match (remember, this has to be fully JSON escaped, not just a valid regex, otherwise it ''will not work'')": {
+        "id": "Optional, but recommended. A stable name for the rule (letters, numbers, underscores and hyphens), used for it in logs, the audit log, edit caps, metrics, exclusions, opt-outs and the sandbox, so that those all carry on working if the regex is changed. Without one, the rule is identified by a hash of its regex instead, which changes whenever the regex does.",
         "task": "Brief description of task",
 		"example": "Example of something that would be tagged by the task",
 		"noTagIf": "A regex which, if it matches against the page, will cause the page to be ignored. Usually used to avoid tagging pages that already contain maintenance tags. Use boolean false to always tag; be careful with this! Like the key regex, must be JSON escaped as well as valid regex.",
-		"prefix": "Something to prefix the articles that the task finds with, with $ signs escaped with an additional sign (i.e. $ in output should read $$); each regex capture group is available as "${n}", replacing n with the one-indexed number of the capture group",
-		"suffix": "Same as prefix, but appends to the article rather than prepending",
+		"prefix": "Something to prefix the articles that the task finds with, with $ signs escaped with an additional sign (i.e. $ in output should read $$); each regex capture group is available as "${n}", replacing n with the one-indexed number of the capture group. There are also built-in variables: "${month}" and "${year}" are the current month and year, "${date}" is both (e.g. "October 2026", as maintenance templates' date parameters want), "${title}" is the article's title, "${revtimestamp}" is the timestamp of the revision being tagged, and "${rule}" is the rule's ID. A named capture group with the same name as a built-in variable takes precedence. Anything else after a $ that isn't a capture group or a built-in variable is an error. When checking whether an article is already tagged, the date variables and revtimestamp can have any value, so an article tagged last month won't be tagged again",
+		"suffix": "Same as prefix, but appends to the article rather than prepending. Suffixes go above the article's footer (authority control, DEFAULTSORT, categories and stub templates), except for suffixes made up only of categories, which go after the existing categories, and those made up only of stub templates, which go after the existing stubs.",
+		"placement": "Optional. Where the prefix goes: "top" (the default) puts it at the top of the article, after any hatnotes; "section:<regex>" puts it at the top of the first section whose heading matches the regex; "before:<regex>" puts it on the line before that heading, e.g. "before:References". If there's no matching heading, the rule doesn't apply.",
+		"onlyInCategory": "Optional. A category, or an array of categories, that the article has to be in at least one of for the rule to apply; the Category: prefix is optional.",
+		"notInCategory": "Optional. Like onlyInCategory, but the rule doesn't apply to articles in any of these categories.",
+		"titleMatches": "Optional. A regex that the article's title (with spaces, not underscores) has to match for the rule to apply.",
+		"namespaces": "Optional. An array of the namespace numbers the rule applies to; defaults to [0], i.e. just articles. Scope is checked before the regex is run, and isn't checked at all on sandbox test pages.",
+		"scope": "Optional. Which parts of the article the key regex is run over: "raw" (the default) for all of the wikitext; "prose" for the text outside comments, nowiki/pre/syntaxhighlight/math, refs, templates, HTML tags, categories, files, interlanguage links and headings; "refs" for the insides of <ref> tags; "templates" for the insides of templates; or "headings" for section headings. Comments and nowiki and the like are never matched outside raw. Everything else is masked out rather than removed, so capture groups still work, but noTagIf and conditions always see the raw wikitext.",
+		"optOut": "Optional; defaults to the rule's ID. A name (letters, numbers, underscores and hyphens) that editors can use to stop just this rule from tagging a page, by adding {{bots|deny=Scantag-<name>}} or <!-- Scantag-deny: <name> --> to it; either can list several names separated by commas. Pages opted out are recorded in the audit log.",
+		"conditions": "Optional. A condition tree that has to hold, as well as the key regex matching, for the rule to apply. Each condition is either a regex (as a string, or as {"regex": "..."}), {"all": [conditions...]}, {"any": [conditions...]}, {"not": condition}, or a predicate on the page's metadata, which is min or max followed by one of Bytes (the length of the wikitext), Words (words of prose, as in the prose scope), Refs (<ref> tags), Links (links to other pages, not counting categories, files or interlanguage links), Sections (headings of any level), AgeDays (days since the page was created) or DaysSinceEdit (days since the latest revision), e.g. {"minBytes": 2000} or {"maxLinks": 2}. Finding a page's age takes an extra request for each page, as it can't be fetched with the rest of the batch, so it's only done for pages the key regex and the rest of the conditions have matched, just before they're edited; when scanning a dump, age conditions are assumed to hold, and are checked when the candidates are fetched. For example, {"all": [{"not": "<ref"}, {"not": "\\{\\{sfn"}, {"minBytes": 2000}]}.",
 		"detected": "Describes what was detected and why it's doing something; should come after the word 'detected', and potentially have other detected aspects after it separated with semicolons",
+		"maxEditsPerDay": "Optional. The most edits this rule can make in a day (UTC), counted across restarts. Rules over their cap are skipped, but other rules on the same page still apply.",
+		"maxEditsPerRun": "Optional. The most edits this rule can make in one run, i.e. one full pass over the articles (or, in recent changes mode, since the bot started).",
+		"priority": "Optional; defaults to 0. A whole number, which can be negative. Rules are run in order of priority, highest first, and then in order of ID, so when several rules tag the same page, the tags of higher priority rules come first, as do the things they detected in the edit summary. The sandbox is in the same order.",
+		"group": "Optional. The name of a group of rules that supersede one another, like those adding {{Unreferenced}} and {{More citations needed}}; only the highest priority rule in the group applies to any one page. A rule in the group claims the page once its regex matches and its conditions hold and it isn't opted out of, even if the page is already tagged by it, so lower priority rules in the group are skipped. If its conditions can only be checked just before the edit (as with age conditions), the next rule in the group is kept in reserve, and applies instead if they turn out not to hold. Edit caps don't hand the page on to the next rule. Skipped rules are logged, and recorded in the audit log as superseded.",
 		"testpage": "The page name of a page on which the matching will be tested. When the sandbox is updated, Yapperbot will run Scantag's sandbox rules twice (so that the NoTagIf rule can be tested) over this page. Must be prefixed 'User:Yapperbot/Scantag.sandbox/tests/'."
     }
 }
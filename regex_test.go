@@ -0,0 +1,132 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/antonholmquist/jason"
+)
+
+func TestProcessRegexID(t *testing.T) {
+	tests := []struct {
+		name       string
+		json       string
+		wantID     string
+		wantOptOut string
+	}{
+		{"explicit ID", `{"id": "unsourced", "detected": "x", "noTagIf": false}`, "unsourced", "unsourced"},
+		{"separate opt out", `{"id": "unsourced", "optOut": "claims", "detected": "x", "noTagIf": false}`, "unsourced", "claims"},
+		{"hashed", `{"detected": "x", "noTagIf": false}`, "e7cf7c923396", "e7cf7c923396"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, err := jason.NewValueFromBytes([]byte(test.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule, _, err := processRegex("unsourced claim", content)
+			if err != nil {
+				t.Fatalf("processRegex failed with %s", err)
+			}
+			if rule.ID != test.wantID || rule.OptOut != test.wantOptOut {
+				t.Errorf("processRegex gave ID %q and opt out %q, want %q and %q", rule.ID, rule.OptOut, test.wantID, test.wantOptOut)
+			}
+		})
+	}
+
+	content, _ := jason.NewValueFromBytes([]byte(`{"id": "not {{valid}}", "detected": "x", "noTagIf": false}`))
+	if _, _, err := processRegex("unsourced claim", content); err == nil {
+		t.Error("processRegex accepted an invalid ID")
+	}
+}
+
+func TestSortedRules(t *testing.T) {
+	regexes := map[string]STRegex{
+		"b":      {ID: "b"},
+		"a":      {ID: "a"},
+		"urgent": {ID: "urgent", Priority: 10},
+		"later":  {ID: "later", Priority: -1},
+	}
+
+	var got []string
+	for _, rule := range sortedRules(regexes) {
+		got = append(got, rule.ID)
+	}
+	if want := "urgent a b later"; strings.Join(got, " ") != want {
+		t.Errorf("sortedRules gave %v, want %s", got, want)
+	}
+}
+
+func TestProcessRegexVariables(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		valid  bool
+	}{
+		{"built-in variable", "{{Tag|date=${date}}}", true},
+		{"numbered group", "{{Tag|${1}|$1}}", true},
+		{"whole match", "{{Tag|${0}}}", true},
+		{"named group", "{{Tag|${word}}}", true},
+		{"escaped", "{{Tag|$${data}|$$5}}", true},
+		{"misspelt variable", "{{Tag|date=${data}}}", false},
+		{"group out of range", "{{Tag|${2}}}", false},
+		{"unbraced built-in", "{{Tag|$date}}", false},
+		{"unbraced name running on", "{{Tag|$1st}}", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, field := range []string{"prefix", "suffix"} {
+				rule, _ := json.Marshal(map[string]interface{}{"detected": "x", "noTagIf": false, field: test.prefix})
+				content, err := jason.NewValueFromBytes(rule)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _, err = processRegex(`(?P<word>\w+) claim`, content)
+				if (err == nil) != test.valid {
+					t.Errorf("processRegex gave error %v for %s %s", err, field, test.prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessRegexScopeErrors(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{`{"detected": "x", "noTagIf": false, "namespaces": "zero"}`, "namespaces"},
+		{`{"detected": "x", "noTagIf": false, "scope": "everywhere"}`, "Match scope"},
+	}
+
+	for _, test := range tests {
+		content, err := jason.NewValueFromBytes([]byte(test.json))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := processRegex("claim", content); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("processRegex gave error %v for %s, want one mentioning %s", err, test.json, test.want)
+		}
+	}
+}
@@ -21,7 +21,7 @@ package main
 import (
 	"fmt"
 	"log"
-	"regexp"
+	"sort"
 	"strings"
 
 	"cgt.name/pkg/go-mwclient"
@@ -35,7 +35,7 @@ const sandboxTimestamp string = `{{/ts|%d|%s|%s}}`
 const sandboxHeader string = `<!-- Remove the ts template to force the sandbox to be regenerated -->
 {|class="wikitable"
 |-
-! Task !! Example !! Don't tag if matches !! Use noTagIf? !! Prefix the article with !! Suffix the article with !! Detected... !! Test page
+! Task !! Example !! Don't tag if matches !! Use noTagIf? !! Prefix the article with !! Place the prefix at !! Suffix the article with !! Applies to !! Opt out with !! Matches in !! Only if !! Priority !! Group !! Detected... !! Test page
 `
 
 // Leave the newline at the start of this; it's also important.
@@ -43,12 +43,13 @@ const sandboxFooter string = `
 |}`
 
 const sandboxTemplateOpening string = `|-
-! colspan="8" | <code><nowiki>%s</nowiki></code>
+! colspan="15" | %s<code><nowiki>%s</nowiki></code>
 |-
 | `
+const sandboxTemplateID string = `<code>%s</code>: `
 const sandboxTemplateCode string = `<code><nowiki>%v</nowiki></code>`
 const sandboxTemplateNoCode string = `<nowiki>%v</nowiki>`
-const sandboxError string = `colspan="8" {{no O|<code><nowiki>%s</nowiki></code>}}`
+const sandboxError string = `colspan="15" {{no O|<code><nowiki>%s</nowiki></code>}}`
 
 func createSandbox(w *mwclient.Client) {
 	sandboxMetaQuery, err := w.Get(params.Values{
@@ -58,6 +59,7 @@ func createSandbox(w *mwclient.Client) {
 		"rvprop":  "ids|timestamp|user",
 	})
 	if err != nil {
+		metrics.apiCallFailed(err)
 		ybtools.PanicErr("Failed to fetch sandbox JSON metadata with error ", err)
 	}
 
@@ -82,9 +84,9 @@ func createSandbox(w *mwclient.Client) {
 
 	sandboxTS := fmt.Sprintf(sandboxTimestamp, revid, ts, user)
 
-	sandboxJSON := ybtools.LoadJSONFromPageID(config.SandboxJSONPageID)
+	sandboxJSON := loadJSONFromPageID(w, config.SandboxJSONPageID)
 
-	sandboxPageText, err := ybtools.FetchWikitext(config.SandboxPageID)
+	sandboxPageText, _, _, _, err := fetchPageByID(w, config.SandboxPageID)
 	if err != nil {
 		ybtools.PanicErr("Failed to fetch sandbox page text with error ", err)
 	}
@@ -100,42 +102,80 @@ func createSandbox(w *mwclient.Client) {
 	sandboxBuilder.WriteString(sandboxTS)
 	sandboxBuilder.WriteString(sandboxHeader)
 
+	// the rows go in the same order as the rules are run in, with any invalid rules at the end
+	var rows []sandboxRow
 	for regex, content := range sandboxJSON.Map() {
-		sandboxBuilder.WriteString(fmt.Sprintf(sandboxTemplateOpening, regex))
-		expr, stregex, testpage, err := processRegex(regex, content)
-		if err != nil {
-			sandboxBuilder.WriteString(fmt.Sprintf(sandboxError, err))
+		row := sandboxRow{regex: regex}
+		row.rule, row.testpage, row.err = processRegex(regex, content)
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if (rows[i].err == nil) != (rows[j].err == nil) {
+			return rows[i].err == nil
+		}
+		if rows[i].err != nil {
+			return rows[i].regex < rows[j].regex
+		}
+		return ruleBefore(rows[i].rule, rows[j].rule)
+	})
+
+	for _, row := range rows {
+		regex, stregex, testpage := row.regex, row.rule, row.testpage
+		if row.err != nil {
+			sandboxBuilder.WriteString(fmt.Sprintf(sandboxTemplateOpening, "", regex))
+			sandboxBuilder.WriteString(fmt.Sprintf(sandboxError, row.err))
 			continue
 		}
+		sandboxBuilder.WriteString(fmt.Sprintf(sandboxTemplateOpening, fmt.Sprintf(sandboxTemplateID, stregex.ID), regex))
 
 		writeCell(&sandboxBuilder, sandboxTemplateNoCode, stregex.Task)
 
-		for _, thing := range []interface{}{stregex.Example, stregex.NoTagIf, stregex.UseNTI, stregex.Prefix, stregex.Suffix} {
+		for _, thing := range []interface{}{stregex.Example, stregex.NoTagIf, stregex.UseNTI, stregex.Prefix, stregex.Placement, stregex.Suffix} {
 			writeCell(&sandboxBuilder, sandboxTemplateCode, thing)
 		}
 
+		writeCell(&sandboxBuilder, sandboxTemplateNoCode, stregex.PageScope)
+		var optOut string
+		if stregex.OptOut != "" {
+			optOut = fmt.Sprintf(optOutTemplate, stregex.OptOut)
+		}
+		writeCell(&sandboxBuilder, sandboxTemplateCode, optOut)
+		writeCell(&sandboxBuilder, sandboxTemplateNoCode, stregex.MatchScope)
+		var conditions string
+		if stregex.Conditions != nil {
+			conditions = stregex.Conditions.String()
+		}
+		writeCell(&sandboxBuilder, sandboxTemplateCode, conditions)
+		writeCell(&sandboxBuilder, sandboxTemplateNoCode, stregex.Priority)
+		writeCell(&sandboxBuilder, sandboxTemplateNoCode, stregex.Group)
+
 		writeCell(&sandboxBuilder, sandboxTemplateNoCode, stregex.Detected)
 
 		if testpage != "" {
 			if strings.HasPrefix(testpage, "User:Yapperbot/Scantag.sandbox/tests/") {
 				log.Println("Processing test page", testpage)
-				mapThisRegex := map[*regexp.Regexp]STRegex{expr: stregex}
+				mapThisRegex := map[string]STRegex{stregex.ID: stregex}
 
 				sandboxBuilder.WriteString("{{ph|")
 				sandboxBuilder.WriteString(testpage)
-				content, revTS, curTS, err := ybtools.FetchWikitextFromTitleWithTimestamps(testpage)
+				content, revTS, curTS, missing, err := fetchPage(w, testpage)
 				if err != nil {
-					if apierr, ok := err.(mwclient.APIError); ok && apierr.Code == "missingtitle" {
-						sandboxBuilder.WriteString("|Page does not exist}}")
+					log.Println("Failed to fetch wikitext from testpage in sandbox", testpage, "with error", err)
+					sandboxBuilder.WriteString("|Errored when retrieving page}}")
+				} else if missing {
+					sandboxBuilder.WriteString("|Page does not exist}}")
+				} else {
+					processArticle(w, testpage, content, revTS, curTS, mapThisRegex, true, 0)
+
+					// run again over the page as the first run left it, so that noTagIf gets tested
+					content, revTS, curTS, _, err = fetchPage(w, testpage)
+					if err != nil {
+						log.Println("Failed to refetch testpage in sandbox", testpage, "with error", err)
 					} else {
-						log.Println("Failed to fetch wikitext from testpage in sandbox", testpage, "with error", err)
-						sandboxBuilder.WriteString("|Errored when retrieving page}}")
+						processArticle(w, testpage, content, revTS, curTS, mapThisRegex, true, 0)
 					}
+					sandboxBuilder.WriteString("|Up-to-date}}")
 				}
-
-				processArticle(w, testpage, content, revTS, curTS, mapThisRegex, true, 0)
-				processArticle(w, testpage, content, revTS, curTS, mapThisRegex, true, 0)
-				sandboxBuilder.WriteString("|Up-to-date}}")
 			} else {
 				log.Println("Invalid test page", testpage)
 			}
@@ -156,6 +196,7 @@ func createSandbox(w *mwclient.Client) {
 		if err == mwclient.ErrEditNoChange {
 			log.Println("Detected sandbox changes to update, but looks like there actually weren't any")
 		} else {
+			metrics.apiCallFailed(err)
 			switch err.(type) {
 			case mwclient.APIError:
 				switch err.(mwclient.APIError).Code {
@@ -171,6 +212,14 @@ func createSandbox(w *mwclient.Client) {
 	}
 }
 
+// sandboxRow is a rule from the sandbox JSON, or the error from processing it
+type sandboxRow struct {
+	regex    string
+	rule     STRegex
+	testpage string
+	err      error
+}
+
 func writeCell(builder *strings.Builder, templateType string, thing interface{}) {
 	builder.WriteString(fmt.Sprintf(templateType, thing))
 	builder.WriteString(" || ")
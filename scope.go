@@ -0,0 +1,201 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/antonholmquist/jason"
+)
+
+const categoryPrefix string = "Category:"
+
+// Rules with no namespaces set only apply to articles, as Scantag always has
+var defaultNamespaces = []int{0}
+
+// ruleScope limits which pages a rule applies to. It's checked before the rule's regex is run.
+type ruleScope struct {
+	OnlyInCategory []string
+	NotInCategory  []string
+	TitleMatches   *regexp.Regexp
+	Namespaces     []int
+}
+
+// normaliseCategory turns a category name from Scantag.json into the form the API
+// gives categories in, so that "foo_bar" and "Category:Foo bar" are the same thing.
+func normaliseCategory(category string) string {
+	category = strings.TrimSpace(strings.ReplaceAll(category, "_", " "))
+	if len(category) >= len(categoryPrefix) && strings.EqualFold(category[:len(categoryPrefix)], categoryPrefix) {
+		category = strings.TrimSpace(category[len(categoryPrefix):])
+	}
+	first, size := utf8.DecodeRuneInString(category)
+	return categoryPrefix + string(unicode.ToUpper(first)) + category[size:]
+}
+
+// parseScope reads the scope fields of a rule, all of which are optional
+func parseScope(value *jason.Object) (scope ruleScope, err error) {
+	if scope.OnlyInCategory, err = optionalCategories(value, "onlyInCategory"); err != nil {
+		return
+	}
+	if scope.NotInCategory, err = optionalCategories(value, "notInCategory"); err != nil {
+		return
+	}
+
+	if titleMatches, titleErr := value.GetString("titleMatches"); titleErr == nil {
+		if scope.TitleMatches, err = regexp.Compile("(?i)" + titleMatches); err != nil {
+			err = fmt.Errorf("titleMatches is invalid: %s", err)
+			return
+		}
+	} else if _, missingErr := value.GetValue("titleMatches"); missingErr == nil {
+		err = fmt.Errorf("titleMatches must be a regex")
+		return
+	}
+
+	scope.Namespaces = defaultNamespaces
+	if _, missingErr := value.GetValue("namespaces"); missingErr == nil {
+		namespaces, nsErr := value.GetInt64Array("namespaces")
+		if nsErr != nil || len(namespaces) == 0 {
+			err = fmt.Errorf("namespaces must be a non-empty array of namespace numbers")
+			return
+		}
+		scope.Namespaces = nil
+		for _, namespace := range namespaces {
+			scope.Namespaces = append(scope.Namespaces, int(namespace))
+		}
+	}
+	return
+}
+
+// optionalCategories gets a category, or an array of them, from a rule
+func optionalCategories(value *jason.Object, key string) ([]string, error) {
+	if _, err := value.GetValue(key); err != nil {
+		return nil, nil
+	}
+
+	var categories []string
+	if category, err := value.GetString(key); err == nil {
+		categories = []string{category}
+	} else if categories, err = value.GetStringArray(key); err != nil {
+		return nil, fmt.Errorf("%s must be a category name or an array of them", key)
+	}
+
+	for i, category := range categories {
+		categories[i] = normaliseCategory(category)
+	}
+	return categories, nil
+}
+
+// inScope returns whether a rule applies to page at all. If the page's categories
+// weren't fetched, as when scanning a dump, the category conditions are assumed to pass;
+// the page will be checked again properly when it's fetched from the wiki.
+func (scope ruleScope) inScope(page fetchedPage) bool {
+	if !scope.inNamespace(page.namespace) {
+		return false
+	}
+	if scope.TitleMatches != nil && !scope.TitleMatches.MatchString(strings.ReplaceAll(page.title, "_", " ")) {
+		return false
+	}
+	if !page.haveCategories {
+		return true
+	}
+
+	if len(scope.OnlyInCategory) > 0 && !inAnyCategory(page.categories, scope.OnlyInCategory) {
+		return false
+	}
+	return !inAnyCategory(page.categories, scope.NotInCategory)
+}
+
+// namespaces returns the namespaces the rule applies to, allowing for rules made
+// without going through parseScope
+func (scope ruleScope) namespaces() []int {
+	if scope.Namespaces == nil {
+		return defaultNamespaces
+	}
+	return scope.Namespaces
+}
+
+func (scope ruleScope) inNamespace(namespace int) bool {
+	for _, allowed := range scope.namespaces() {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func inAnyCategory(pageCategories, categories []string) bool {
+	for _, pageCategory := range pageCategories {
+		for _, category := range categories {
+			if pageCategory == category {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String describes the scope for the sandbox
+func (scope ruleScope) String() string {
+	var parts []string
+
+	parts = append(parts, "namespaces "+strings.ReplaceAll(namespaceList(scope.namespaces()), "|", ", "))
+
+	if scope.TitleMatches != nil {
+		parts = append(parts, "titles matching "+scope.TitleMatches.String())
+	}
+	if len(scope.OnlyInCategory) > 0 {
+		parts = append(parts, "in "+strings.Join(scope.OnlyInCategory, " or "))
+	}
+	if len(scope.NotInCategory) > 0 {
+		parts = append(parts, "not in "+strings.Join(scope.NotInCategory, " or "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// namespaceList formats namespaces for an API parameter
+func namespaceList(namespaces []int) string {
+	var names []string
+	for _, namespace := range namespaces {
+		names = append(names, strconv.Itoa(namespace))
+	}
+	return strings.Join(names, "|")
+}
+
+// ruleNamespaces returns every namespace that at least one of the regexes applies to,
+// so that we know which namespaces to look at in recent changes and dumps.
+func ruleNamespaces(regexes map[string]STRegex) []int {
+	seen := map[int]bool{}
+	var namespaces []int
+	for _, rule := range regexes {
+		for _, namespace := range rule.PageScope.namespaces() {
+			if !seen[namespace] {
+				seen[namespace] = true
+				namespaces = append(namespaces, namespace)
+			}
+		}
+	}
+	sort.Ints(namespaces)
+	return namespaces
+}
@@ -0,0 +1,110 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/antonholmquist/jason"
+)
+
+func TestNormaliseCategory(t *testing.T) {
+	for _, category := range []string{"Living people", "living_people", "Category:Living people", "category: living people"} {
+		if got := normaliseCategory(category); got != "Category:Living people" {
+			t.Errorf("normaliseCategory(%q) gave %q", category, got)
+		}
+	}
+}
+
+func TestInScope(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope string
+		page  fetchedPage
+		want  bool
+	}{
+		{"no scope", `{}`, fetchedPage{title: "Foo"}, true},
+		{"not an article", `{}`, fetchedPage{title: "User:Foo", namespace: 2}, false},
+		{"allowed namespace", `{"namespaces": [2, 14]}`, fetchedPage{title: "Category:Foo", namespace: 14}, true},
+		{"title matches", `{"titleMatches": "^list of"}`, fetchedPage{title: "List_of_things"}, true},
+		{"title doesn't match", `{"titleMatches": "^list of"}`, fetchedPage{title: "Things"}, false},
+		{"in category", `{"onlyInCategory": ["Stubs", "Living people"]}`,
+			fetchedPage{title: "Foo", categories: []string{"Category:Living people"}, haveCategories: true}, true},
+		{"not in category", `{"onlyInCategory": "Living people"}`,
+			fetchedPage{title: "Foo", categories: []string{"Category:Dead people"}, haveCategories: true}, false},
+		{"in excluded category", `{"notInCategory": "Dead_people"}`,
+			fetchedPage{title: "Foo", categories: []string{"Category:Dead people"}, haveCategories: true}, false},
+		{"categories unknown", `{"onlyInCategory": "Living people"}`, fetchedPage{title: "Foo"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := jason.NewObjectFromBytes([]byte(test.scope))
+			if err != nil {
+				t.Fatal("Bad test scope:", err)
+			}
+			scope, err := parseScope(value)
+			if err != nil {
+				t.Fatal("parseScope failed:", err)
+			}
+			if got := scope.inScope(test.page); got != test.want {
+				t.Errorf("inScope gave %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseScopeInvalid(t *testing.T) {
+	for _, scope := range []string{`{"namespaces": []}`, `{"namespaces": "0"}`, `{"titleMatches": "("}`, `{"onlyInCategory": 5}`} {
+		value, _ := jason.NewObjectFromBytes([]byte(scope))
+		if _, err := parseScope(value); err == nil {
+			t.Errorf("parseScope accepted %s", scope)
+		}
+	}
+}
+
+func TestProcessBatchScoped(t *testing.T) {
+	fw, w := setupFlowTest(t)
+	config.RegexesJSONPageID = strconv.Itoa(fw.setPage("User:Yapperbot/Scantag.json", `{
+		"unsourced claim": {
+			"detected": "an unsourced claim",
+			"noTagIf": "\\{\\{unreferenced",
+			"prefix": "{{Unreferenced|date=October 2026}}\n",
+			"notInCategory": "Lists",
+			"namespaces": [0, 14]
+		}
+	}`))
+	loadRegexes(w)
+
+	fw.setPage("Article", "This is an unsourced claim.\n[[Category:Things]]")
+	fw.setPage("List", "This is an unsourced claim.\n[[Category:Lists]]")
+	fw.setPage("Category:Things", "This is an unsourced claim.")
+	fw.setPage("User:Someone", "This is an unsourced claim.")
+
+	var processed uint64
+	processBatch(w, []string{"Article", "List", "Category:Things", "User:Someone"}, &processed)
+
+	for title, want := range map[string]bool{"Article": true, "List": false, "Category:Things": true, "User:Someone": false} {
+		if tagged := strings.HasPrefix(fw.text(title), "{{Unreferenced"); tagged != want {
+			t.Errorf("%s tagged: %v, want %v; text is now:\n%s", title, tagged, want, fw.text(title))
+		}
+	}
+}
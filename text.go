@@ -57,5 +57,190 @@ func init() {
 func insertMaintenanceTemplate(text, prepend string) string {
 	// Replace whatever our start regex matches with itself, plus then the prepend value
 	// We replace the dollar signs in the prepend value because those are consumed by ReplaceAllString otherwise
-	return startRegex.ReplaceAllString(text, "$1"+strings.ReplaceAll(prepend, "$", "$$"))
+	return startRegex.ReplaceAllString(text, "${1}"+strings.ReplaceAll(prepend, "$", "$$"))
+}
+
+// The kinds of placement a rule's prefix can have
+const (
+	placementTop     string = "top"
+	placementSection string = "section"
+	placementBefore  string = "before"
+)
+
+// Matches a wikitext heading on a line of its own, capturing the heading text
+var headingRegex = regexp.MustCompile(`(?m)^=+[ \t]*(.+?)[ \t]*=+[ \t]*$`)
+
+// tagPlacement says where in an article a rule's prefix should go: at the top of the
+// article (after hatnotes and the like), at the top of a section, or before a heading.
+type tagPlacement struct {
+	kind    string
+	heading *regexp.Regexp
+	// raw is the placement as it was written in the JSON, for the sandbox
+	raw string
+}
+
+func (p tagPlacement) String() string {
+	if p.raw == "" {
+		return placementTop
+	}
+	return p.raw
+}
+
+// findHeading returns the start and end of the line holding the first heading whose
+// text matches heading, or nil if there isn't one.
+func findHeading(text string, heading *regexp.Regexp) []int {
+	for _, match := range headingRegex.FindAllStringSubmatchIndex(text, -1) {
+		if heading.MatchString(text[match[2]:match[3]]) {
+			return match[:2]
+		}
+	}
+	return nil
+}
+
+// canPlace returns whether text has somewhere to put a tag with the given placement
+func canPlace(text string, placement tagPlacement) bool {
+	return placement.kind == placementTop || placement.kind == "" || findHeading(text, placement.heading) != nil
+}
+
+// insertAtPlacement inserts tag into text according to placement. Placements other than
+// the top of the article have to be checked with canPlace first.
+func insertAtPlacement(text, tag string, placement tagPlacement) string {
+	if placement.kind == placementTop || placement.kind == "" {
+		return insertMaintenanceTemplate(text, tag)
+	}
+
+	// tags placed around headings need to be on a line of their own
+	if !strings.HasSuffix(tag, "\n") {
+		tag += "\n"
+	}
+
+	heading := findHeading(text, placement.heading)
+	switch placement.kind {
+	case placementSection:
+		// straight after the heading line
+		end := heading[1]
+		if end == len(text) {
+			return text + "\n" + tag
+		}
+		return text[:end+1] + tag + text[end+1:]
+	default:
+		// placementBefore, so right before the heading line
+		return text[:heading[0]] + tag + text[heading[0]:]
+	}
+}
+
+// The kinds of line that make up the standard footer at the bottom of an article.
+// Navboxes come before all of these, so anything that isn't one of them ends the footer.
+const (
+	footerContent int = iota
+	footerBlank
+	footerAuthorityControl
+	footerDefaultSort
+	footerCategory
+	footerStub
+	footerInterlanguage
+)
+
+var footerRegexes = []struct {
+	kind  int
+	regex *regexp.Regexp
+}{
+	{footerAuthorityControl, regexp.MustCompile(`(?i)^\s*\{\{\s*(?:authority control|taxonbar)\s*(?:\|[^{}]*)?\}\}\s*$`)},
+	{footerDefaultSort, regexp.MustCompile(`(?i)^\s*\{\{\s*(?:DEFAULTSORT|DEFAULTSORTKEY|DEFAULTCATEGORYSORT)\s*:[^{}]*\}\}\s*$`)},
+	{footerCategory, regexp.MustCompile(`(?i)^\s*(?:\[\[\s*Category\s*:[^\[\]]*\]\]\s*)+$`)},
+	{footerStub, regexp.MustCompile(`(?i)^\s*(?:\{\{\s*(?:[^{}|]*-)?stub\s*(?:\|[^{}]*)?\}\}\s*)+$`)},
+	{footerInterlanguage, regexp.MustCompile(`^\s*(?:\[\[\s*(?:` + strings.Join(interlanguagePrefixes, "|") + `)\s*:[^\[\]]+\]\]\s*)+$`)},
+}
+
+// footerKind works out which part of the article footer a line belongs to, if any
+func footerKind(line string) int {
+	if strings.TrimSpace(line) == "" {
+		return footerBlank
+	}
+	for _, footer := range footerRegexes {
+		if footer.regex.MatchString(line) {
+			return footer.kind
+		}
+	}
+	return footerContent
+}
+
+// suffixKind works out whether a suffix is made up of categories, stub templates, or
+// anything else; anything else is treated as ordinary content.
+func suffixKind(suffix string) int {
+	kind := footerContent
+	for _, line := range strings.Split(suffix, "\n") {
+		lineKind := footerKind(line)
+		if lineKind == footerBlank {
+			continue
+		}
+		if (lineKind != footerCategory && lineKind != footerStub) || (kind != footerContent && kind != lineKind) {
+			return footerContent
+		}
+		kind = lineKind
+	}
+	return kind
+}
+
+// insertSuffix adds suffix to the bottom of text, keeping to the standard order of the
+// article footer: other content (like navboxes) goes before authority control, which is
+// followed by DEFAULTSORT, categories, stub templates and interlanguage links.
+// Categories go after the existing categories, and stub templates after the existing stubs.
+func insertSuffix(text, suffix string) string {
+	trimmed := strings.Trim(suffix, "\n")
+	if trimmed == "" {
+		return text + suffix
+	}
+
+	lines := strings.Split(text, "\n")
+
+	// walk back up from the bottom of the article to find where the footer starts
+	footerStart := len(lines)
+	for footerStart > 0 && footerKind(lines[footerStart-1]) != footerContent {
+		footerStart--
+	}
+	// blank lines before the footer are part of the content, not the footer
+	for footerStart < len(lines) && footerKind(lines[footerStart]) == footerBlank {
+		footerStart++
+	}
+	if footerStart == len(lines) {
+		// no footer at all, so there's nothing to get in front of
+		return text + suffix
+	}
+
+	kind := suffixKind(trimmed)
+
+	// insert after the last line of the same kind if there is one, else before the first
+	// line of a kind that comes later, else at the very end of the footer
+	insertAt := -1
+	for i := footerStart; i < len(lines); i++ {
+		lineKind := footerKind(lines[i])
+		if lineKind == footerBlank {
+			continue
+		}
+		if kind != footerContent && lineKind == kind {
+			insertAt = i + 1
+		} else if lineKind > kind && insertAt == -1 {
+			insertAt = i
+			break
+		}
+	}
+	if insertAt == -1 {
+		// after the last non-blank line
+		insertAt = len(lines)
+		for footerKind(lines[insertAt-1]) == footerBlank {
+			insertAt--
+		}
+	} else if kind == footerContent {
+		// content goes before any blank lines separating it from the footer
+		for insertAt > 0 && footerKind(lines[insertAt-1]) == footerBlank {
+			insertAt--
+		}
+	}
+
+	result := make([]string, 0, len(lines)+1)
+	result = append(result, lines[:insertAt]...)
+	result = append(result, trimmed)
+	result = append(result, lines[insertAt:]...)
+	return strings.Join(result, "\n")
 }
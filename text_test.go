@@ -0,0 +1,212 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import "testing"
+
+const placementTestArticle string = `{{Short description|A thing}}
+A thing is a thing.
+
+== History ==
+It happened.
+
+=== Early history ===
+It happened earlier.
+
+== References ==
+{{Reflist}}`
+
+func TestInsertAtPlacement(t *testing.T) {
+	tests := []struct {
+		name      string
+		placement string
+		tag       string
+		want      string
+	}{
+		{"top", "", "{{Tag}}\n", `{{Short description|A thing}}
+{{Tag}}
+A thing is a thing.
+
+== History ==
+It happened.
+
+=== Early history ===
+It happened earlier.
+
+== References ==
+{{Reflist}}`},
+		{"section", "section:^history$", "{{Unreferenced section}}", `{{Short description|A thing}}
+A thing is a thing.
+
+== History ==
+{{Unreferenced section}}
+It happened.
+
+=== Early history ===
+It happened earlier.
+
+== References ==
+{{Reflist}}`},
+		{"subsection", "section:early", "{{Tag}}\n", `{{Short description|A thing}}
+A thing is a thing.
+
+== History ==
+It happened.
+
+=== Early history ===
+{{Tag}}
+It happened earlier.
+
+== References ==
+{{Reflist}}`},
+		{"before", "before:References", "== See also ==\n* [[Other thing]]\n\n", `{{Short description|A thing}}
+A thing is a thing.
+
+== History ==
+It happened.
+
+=== Early history ===
+It happened earlier.
+
+== See also ==
+* [[Other thing]]
+
+== References ==
+{{Reflist}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			placement, err := parsePlacement(test.placement)
+			if err != nil {
+				t.Fatal("parsePlacement failed:", err)
+			}
+			if !canPlace(placementTestArticle, placement) {
+				t.Fatal("canPlace returned false")
+			}
+			if got := insertAtPlacement(placementTestArticle, test.tag, placement); got != test.want {
+				t.Errorf("insertAtPlacement gave:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInsertAtPlacementLastLineHeading(t *testing.T) {
+	placement, _ := parsePlacement("section:External links")
+	got := insertAtPlacement("Text\n== External links ==", "{{Tag}}", placement)
+	if want := "Text\n== External links ==\n{{Tag}}\n"; got != want {
+		t.Errorf("insertAtPlacement gave %q, want %q", got, want)
+	}
+}
+
+func TestPlacementWithoutHeading(t *testing.T) {
+	placement, _ := parsePlacement("section:Reception")
+	if canPlace(placementTestArticle, placement) {
+		t.Error("canPlace returned true for a section that doesn't exist")
+	}
+}
+
+func TestParsePlacementInvalid(t *testing.T) {
+	for _, placement := range []string{"middle", "after:References", "section:(unclosed"} {
+		if _, err := parsePlacement(placement); err == nil {
+			t.Errorf("parsePlacement accepted %q", placement)
+		}
+	}
+}
+
+const suffixTestArticle string = `Some article text.
+
+== References ==
+{{Reflist}}
+
+{{Some navbox}}
+
+{{Authority control}}
+{{DEFAULTSORT:Article, Some}}
+[[Category:Things]]
+[[Category:Other things]]
+
+{{Thing-stub}}
+`
+
+func TestInsertSuffix(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		suffix string
+		want   string
+	}{
+		{"content", suffixTestArticle, "\n{{Another navbox}}", `Some article text.
+
+== References ==
+{{Reflist}}
+
+{{Some navbox}}
+{{Another navbox}}
+
+{{Authority control}}
+{{DEFAULTSORT:Article, Some}}
+[[Category:Things]]
+[[Category:Other things]]
+
+{{Thing-stub}}
+`},
+		{"category", suffixTestArticle, "\n[[Category:More things]]", `Some article text.
+
+== References ==
+{{Reflist}}
+
+{{Some navbox}}
+
+{{Authority control}}
+{{DEFAULTSORT:Article, Some}}
+[[Category:Things]]
+[[Category:Other things]]
+[[Category:More things]]
+
+{{Thing-stub}}
+`},
+		{"stub", suffixTestArticle, "{{Other-stub}}", `Some article text.
+
+== References ==
+{{Reflist}}
+
+{{Some navbox}}
+
+{{Authority control}}
+{{DEFAULTSORT:Article, Some}}
+[[Category:Things]]
+[[Category:Other things]]
+
+{{Thing-stub}}
+{{Other-stub}}
+`},
+		{"category without categories", "Text.\n\n{{Stub}}\n[[de:Text]]", "\n[[Category:Things]]", "Text.\n\n[[Category:Things]]\n{{Stub}}\n[[de:Text]]"},
+		{"stub before interlanguage links", "Text.\n[[Category:Things]]\n[[de:Text]]", "\n{{Stub}}", "Text.\n[[Category:Things]]\n{{Stub}}\n[[de:Text]]"},
+		{"no footer", "Text.", "\n{{Stub}}", "Text.\n{{Stub}}"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := insertSuffix(test.text, test.suffix); got != test.want {
+				t.Errorf("insertSuffix gave:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
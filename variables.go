@@ -0,0 +1,130 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matches an escaped dollar sign, or a ${name} that might be a built-in variable
+var variableRegex = regexp.MustCompile(`\$(?:\$|\{(\w+)\})`)
+
+// Matches everything regexp.ExpandString treats as a reference: an escaped dollar sign,
+// ${name}, or $name, where the name is as long as it can be
+var referenceRegex = regexp.MustCompile(`\$(?:\$|\{(\w+)\}|(\w+))`)
+
+// Built-in variables whose values change over time, so that an article tagged on
+// a previous run will have a different value in the tag to the one we'd add now
+var timeVaryingVariables = map[string]bool{
+	"month":        true,
+	"year":         true,
+	"date":         true,
+	"revtimestamp": true,
+}
+
+// Stands in for time-varying variables when checking whether an article is already tagged
+const variableSentinel string = "\x00"
+
+// What a time-varying variable can match when checking whether an article is already tagged
+const variableWildcard string = `[^|{}\n]*?`
+
+// tagVariables returns the built-in variables available to a rule's prefix and suffix
+func tagVariables(title, revTS, rule string, now time.Time) map[string]string {
+	return map[string]string{
+		"month":        now.Format("January"),
+		"year":         now.Format("2006"),
+		"date":         now.Format("January 2006"),
+		"title":        strings.ReplaceAll(title, "_", " "),
+		"revtimestamp": revTS,
+		"rule":         rule,
+	}
+}
+
+// expandVariables replaces the built-in variables in template with their values, leaving
+// everything else for regexp.ExpandString. A named capture group in regex takes
+// precedence over a built-in variable of the same name. If sentinel is true,
+// time-varying variables are replaced with variableSentinel instead.
+func expandVariables(template string, regex *regexp.Regexp, variables map[string]string, sentinel bool) string {
+	named := map[string]bool{}
+	for _, name := range regex.SubexpNames() {
+		named[name] = true
+	}
+
+	return variableRegex.ReplaceAllStringFunc(template, func(match string) string {
+		if match == "$$" {
+			return match
+		}
+		name := match[2 : len(match)-1]
+		value, ok := variables[name]
+		if !ok || named[name] {
+			return match
+		}
+		if sentinel && timeVaryingVariables[name] {
+			return variableSentinel
+		}
+		// escape any dollar signs, as the result still has to go through ExpandString
+		return strings.ReplaceAll(value, "$", "$$")
+	})
+}
+
+// checkVariables makes sure that every reference in template (a rule's prefix or suffix)
+// is to a capture group in regex or a built-in variable. ExpandString quietly replaces
+// anything else with nothing, so a typo would otherwise end up tagging articles with
+// an empty parameter.
+func checkVariables(template string, regex *regexp.Regexp) error {
+	named := map[string]bool{}
+	for _, name := range regex.SubexpNames() {
+		named[name] = true
+	}
+	builtIn := tagVariables("", "", "", time.Time{})
+
+	for _, match := range referenceRegex.FindAllStringSubmatch(template, -1) {
+		braced, name := match[1] != "", match[1]+match[2]
+		if match[0] == "$$" || named[name] {
+			continue
+		}
+		if index, err := strconv.Atoi(name); err == nil && index <= regex.NumSubexp() {
+			continue
+		}
+		if _, ok := builtIn[name]; ok {
+			if braced {
+				continue
+			}
+			return fmt.Errorf("`%s` has to be written as `${%s}`", match[0], name)
+		}
+		return fmt.Errorf("`%s` isn't a capture group of the regex or a built-in variable; use $$ for a literal $", match[0])
+	}
+	return nil
+}
+
+// alreadyTagged returns whether text already contains template as expanded for match,
+// allowing for time-varying variables to have any value.
+func alreadyTagged(text string, regex *regexp.Regexp, template string, match []int, variables map[string]string) bool {
+	formatted := string(regex.ExpandString([]byte{}, expandVariables(template, regex, variables, true), text, match))
+	if !strings.Contains(formatted, variableSentinel) {
+		return strings.Contains(text, formatted)
+	}
+
+	pattern := strings.ReplaceAll(regexp.QuoteMeta(formatted), variableSentinel, variableWildcard)
+	return regexp.MustCompile(pattern).MatchString(text)
+}
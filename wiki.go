@@ -0,0 +1,259 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/antonholmquist/jason"
+	"github.com/mashedkeyboard/ybtools/v2"
+)
+
+// fetchPage gets the current wikitext of title, along with the timestamp of its
+// latest revision and the current timestamp, for use in edit conflict detection.
+// Unlike the ybtools fetchers, a page that doesn't exist isn't an error; it just
+// comes back with missing set, so that it can be created.
+func fetchPage(w *mwclient.Client, title string) (text, revTS, curTS string, missing bool, err error) {
+	return fetchPageFrom(w, "titles", title)
+}
+
+// fetchPageByID is fetchPage, but using a page ID rather than a title
+func fetchPageByID(w *mwclient.Client, pageID string) (text, revTS, curTS string, missing bool, err error) {
+	return fetchPageFrom(w, "pageids", pageID)
+}
+
+func fetchPageFrom(w *mwclient.Client, identifierName, identifier string) (text, revTS, curTS string, missing bool, err error) {
+	resp, err := w.Get(params.Values{
+		"action":       "query",
+		identifierName: identifier,
+		"prop":         "revisions",
+		"curtimestamp": "1",
+		"rvprop":       "timestamp|content",
+		"rvslots":      "main",
+	})
+	if err != nil {
+		metrics.apiCallFailed(err)
+		return
+	}
+
+	curTS, err = resp.GetString("curtimestamp")
+	if err != nil {
+		return
+	}
+
+	pages := ybtools.GetPagesFromQuery(resp)
+	if len(pages) < 1 {
+		err = mwclient.ErrPageNotFound
+		return
+	}
+
+	if _, missingErr := pages[0].GetValue("missing"); missingErr == nil {
+		missing = true
+		return
+	}
+
+	revisions, err := pages[0].GetObjectArray("revisions")
+	if err != nil {
+		return
+	}
+
+	revTS, err = revisions[0].GetString("timestamp")
+	if err != nil {
+		return
+	}
+
+	text, err = ybtools.GetMainSlotFromRevision(revisions[0])
+	return
+}
+
+// loadJSONFromPageID fetches and parses the JSON on the page with the given ID,
+// dying if it can't; it's the equivalent of ybtools.LoadJSONFromPageID using w.
+func loadJSONFromPageID(w *mwclient.Client, pageID string) *jason.Object {
+	text, _, _, missing, err := fetchPageByID(w, pageID)
+	if err != nil {
+		ybtools.PanicErr("Failed to fetch JSON page ", pageID, " with error ", err)
+	}
+	if missing {
+		ybtools.PanicErr("JSON page ", pageID, " doesn't exist")
+	}
+
+	parsed, err := jason.NewObjectFromBytes([]byte(text))
+	if err != nil {
+		ybtools.PanicErr("Failed to parse JSON page ", pageID, " with error ", err)
+	}
+	return parsed
+}
+
+// fetchBatch gets the content and categories of every page in titles, skipping any
+// that are missing, and dying if the query fails.
+func fetchBatch(w *mwclient.Client, titles []string) []fetchedPage {
+	pages, err := fetchPages(w, titles)
+	if err != nil {
+		ybtools.PanicErr("Failed to fetch batch with error ", err)
+	}
+	return pages
+}
+
+// fetchPages gets the content and categories of every page in titles, skipping any that
+// are missing. It works the same way as ybtools.ForPageInQuery, but uses w rather than the
+// ybtools client, and returns the pages rather than calling back with each one.
+// Revisions and categories can come back in different continuations of the query,
+// so the parts of each page are put together before anything is returned.
+func fetchPages(w *mwclient.Client, titles []string) (pages []fetchedPage, err error) {
+	query := w.NewQuery(params.Values{
+		"titles":       strings.Join(titles, "|"),
+		"prop":         "revisions|categories",
+		"curtimestamp": "1",
+		"rvprop":       "timestamp|content",
+		"rvslots":      "main",
+		"cllimit":      "max",
+	})
+
+	var order []string
+	byTitle := map[string]*fetchedPage{}
+	for query.Next() {
+		curTS, err := query.Resp().GetString("curtimestamp")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, page := range ybtools.GetPagesFromQuery(query.Resp()) {
+			title, err := page.GetString("title")
+			if err != nil {
+				log.Println("Failed to get title from page, so skipping it. Error was", err)
+				continue
+			}
+
+			if _, err := page.GetValue("missing"); err == nil {
+				log.Printf("Page `%s` is missing, so skipping it: probably deleted\n", title)
+				continue
+			}
+
+			fetched, ok := byTitle[title]
+			if !ok {
+				namespace, _ := page.GetInt64("ns")
+				fetched = &fetchedPage{
+					title:          title,
+					namespace:      int(namespace),
+					curTS:          curTS,
+					haveCategories: true,
+				}
+				byTitle[title] = fetched
+				order = append(order, title)
+			}
+
+			if categories, err := page.GetObjectArray("categories"); err == nil {
+				for _, category := range categories {
+					if categoryTitle, err := category.GetString("title"); err == nil {
+						fetched.categories = append(fetched.categories, categoryTitle)
+					}
+				}
+			}
+
+			revisions, err := page.GetObjectArray("revisions")
+			if err != nil {
+				// the content for this page is in another continuation
+				continue
+			}
+
+			text, err := ybtools.GetMainSlotFromRevision(revisions[0])
+			if err != nil {
+				log.Printf("Failed to get content from page `%s`, so skipping it. Error was %s\n", title, err)
+				continue
+			}
+
+			revTS, err := revisions[0].GetString("timestamp")
+			if err != nil {
+				log.Printf("Failed to get timestamp from revision on page `%s`, so skipping it. Error was %s\n", title, err)
+				continue
+			}
+
+			fetched.text, fetched.revTS, fetched.curTS = text, revTS, curTS
+		}
+	}
+	if err := query.Err(); err != nil {
+		metrics.apiCallFailed(err)
+		return nil, err
+	}
+
+	for _, title := range order {
+		page := byTitle[title]
+		if page.revTS == "" {
+			log.Printf("Failed to get a revision for page `%s`, so skipping it\n", title)
+			continue
+		}
+		pages = append(pages, *page)
+	}
+	return
+}
+
+// creationFetcher returns a function that gets when title was created, fetching it
+// the first time it's called. The API can only give the first revision of one page
+// at a time, so this can't be part of the batch query: it costs a request for every
+// page it's called for. It's only used by editArticle, for pages a rule with an age
+// condition has already matched, so that the requests are made one at a time.
+func creationFetcher(w *mwclient.Client, title string) func() (time.Time, bool) {
+	var once sync.Once
+	var created time.Time
+	var ok bool
+	return func() (time.Time, bool) {
+		once.Do(func() {
+			resp, err := w.Get(params.Values{
+				"action":  "query",
+				"titles":  title,
+				"prop":    "revisions",
+				"rvprop":  "timestamp",
+				"rvlimit": "1",
+				"rvdir":   "newer",
+			})
+			if err != nil {
+				metrics.apiCallFailed(err)
+				log.Println("Failed to fetch creation date of", title, "with error", err)
+				return
+			}
+
+			pages := ybtools.GetPagesFromQuery(resp)
+			if len(pages) < 1 {
+				log.Println("Failed to fetch creation date of", title, "as it wasn't in the response")
+				return
+			}
+			revisions, err := pages[0].GetObjectArray("revisions")
+			if err != nil {
+				log.Println("Failed to get first revision of", title, "with error", err)
+				return
+			}
+			timestamp, err := revisions[0].GetString("timestamp")
+			if err != nil {
+				log.Println("Failed to get timestamp of first revision of", title, "with error", err)
+				return
+			}
+			if created, err = time.Parse(time.RFC3339, timestamp); err != nil {
+				log.Println("First revision of", title, "had invalid timestamp", timestamp)
+				return
+			}
+			ok = true
+		})
+		return created, ok
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The parts of an article a rule's regex can be matched against
+const (
+	matchScopeRaw       string = "raw"
+	matchScopeProse     string = "prose"
+	matchScopeRefs      string = "refs"
+	matchScopeTemplates string = "templates"
+	matchScopeHeadings  string = "headings"
+)
+
+// Each byte of an article is flagged with the kinds of region it's in
+const (
+	regionComment uint8 = 1 << iota
+	// nowiki, pre and the like, whose contents aren't wikitext
+	regionCode
+	regionRef
+	regionTemplate
+	regionHeading
+	// HTML-style tags themselves, as opposed to what's between them, and other markup
+	// that isn't part of the prose, like categories and files
+	regionTag
+)
+
+// Masked bytes are replaced with this; it isn't a word or space character, so
+// it won't join up words on either side of a masked region.
+const maskByte byte = 0
+
+// Tags whose contents aren't parsed as wikitext
+var codeTagRegex = regexp.MustCompile(`(?i)^<(nowiki|pre|syntaxhighlight|source|math)\b[^<>]*?(/?)>`)
+var codeTagClosingRegexes = map[string]*regexp.Regexp{}
+var refOpenRegex = regexp.MustCompile(`(?i)^<ref\b[^<>]*?(/?)>`)
+var refCloseRegex = regexp.MustCompile(`(?i)^</ref\s*>`)
+var tagRegex = regexp.MustCompile(`^</?[a-zA-Z][^<>]*>`)
+
+func init() {
+	for _, name := range []string{"nowiki", "pre", "syntaxhighlight", "source", "math"} {
+		codeTagClosingRegexes[name] = regexp.MustCompile(`(?i)</` + name + `\s*>`)
+	}
+}
+
+// parseMatchScope checks a rule's scope, returning the default of raw if it isn't set
+func parseMatchScope(scope string) (string, error) {
+	switch scope {
+	case "":
+		return matchScopeRaw, nil
+	case matchScopeRaw, matchScopeProse, matchScopeRefs, matchScopeTemplates, matchScopeHeadings:
+		return scope, nil
+	}
+	return "", fmt.Errorf("`%s` isn't one of raw, prose, refs, templates or headings", scope)
+}
+
+// wikitextRegions flags every byte of text with the regions it's in. It's not a parser,
+// just enough of a tokenizer to tell prose from the rest.
+func wikitextRegions(text string) []uint8 {
+	flags := make([]uint8, len(text))
+	mark := func(start, end int, flag uint8) {
+		for i := start; i < end; i++ {
+			flags[i] |= flag
+		}
+	}
+
+	var inRef bool
+	var templateDepth int
+	// the regions we're currently inside, which every byte gets
+	current := func() (flag uint8) {
+		if inRef {
+			flag |= regionRef
+		}
+		if templateDepth > 0 {
+			flag |= regionTemplate
+		}
+		return
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			end := strings.Index(rest[4:], "-->")
+			if end == -1 {
+				end = len(text)
+			} else {
+				end = i + 4 + end + 3
+			}
+			mark(i, end, regionComment|current())
+			i = end
+			continue
+		case rest[0] == '<':
+			if match := codeTagRegex.FindStringSubmatchIndex(rest); match != nil {
+				end := i + match[1]
+				if match[4] == match[5] {
+					// not self-closing, so everything up to the closing tag is code
+					name := strings.ToLower(rest[match[2]:match[3]])
+					if closing := codeTagClosingRegexes[name].FindStringIndex(text[end:]); closing != nil {
+						end += closing[1]
+					} else {
+						end = len(text)
+					}
+				}
+				mark(i, end, regionCode|current())
+				i = end
+				continue
+			}
+			if match := refOpenRegex.FindStringSubmatchIndex(rest); match != nil {
+				mark(i, i+match[1], regionRef|regionTag|current())
+				if match[2] == match[3] {
+					inRef = true
+				}
+				i += match[1]
+				continue
+			}
+			if match := refCloseRegex.FindStringIndex(rest); match != nil {
+				mark(i, i+match[1], regionRef|regionTag|current())
+				inRef = false
+				i += match[1]
+				continue
+			}
+			if match := tagRegex.FindStringIndex(rest); match != nil {
+				mark(i, i+match[1], regionTag|current())
+				i += match[1]
+				continue
+			}
+		case strings.HasPrefix(rest, "[[") && notLinkRegex.MatchString(strings.TrimLeft(rest[2:], " ")):
+			// categories, files and interlanguage links; files can have links in their captions
+			end := closingBrackets(text, i)
+			mark(i, end, regionTag|current())
+			i = end
+			continue
+		case strings.HasPrefix(rest, "{{"):
+			templateDepth++
+			mark(i, i+2, current())
+			i += 2
+			continue
+		case strings.HasPrefix(rest, "}}") && templateDepth > 0:
+			mark(i, i+2, current())
+			templateDepth--
+			i += 2
+			continue
+		}
+		flags[i] |= current()
+		i++
+	}
+
+	for _, heading := range headingRegex.FindAllStringIndex(text, -1) {
+		mark(heading[0], heading[1], regionHeading)
+	}
+	return flags
+}
+
+// closingBrackets returns the index just after the ]] that closes the link opened at start,
+// or the end of the line if it's never closed.
+func closingBrackets(text string, start int) int {
+	depth := 0
+	for i := start; i < len(text)-1; i++ {
+		switch {
+		case text[i] == '\n':
+			return i
+		case text[i:i+2] == "[[":
+			depth++
+			i++
+		case text[i:i+2] == "]]":
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(text)
+}
+
+// inMatchScope returns whether a byte with the given flags is part of scope
+func inMatchScope(flags uint8, scope string) bool {
+	if flags&(regionComment|regionCode) != 0 {
+		return false
+	}
+	switch scope {
+	case matchScopeProse:
+		return flags == 0
+	case matchScopeRefs:
+		// just what's between the ref tags, not the tags themselves
+		return flags&regionRef != 0 && flags&regionTag == 0
+	case matchScopeTemplates:
+		return flags&regionTemplate != 0
+	case matchScopeHeadings:
+		return flags&regionHeading != 0
+	}
+	return true
+}
+
+// textMasker masks an article down to the parts that are in each rule's scope,
+// tokenizing the article at most once however many rules are run over it.
+type textMasker struct {
+	text   string
+	flags  []uint8
+	masked map[string]string
+}
+
+func newTextMasker(text string) *textMasker {
+	return &textMasker{text: text, masked: map[string]string{}}
+}
+
+// mask returns the article with everything outside scope replaced with maskByte.
+// Newlines are always left alone, so that line anchors still work, and every
+// other byte stays where it was, so offsets into the mask are offsets into the article.
+func (m *textMasker) mask(scope string) string {
+	if scope == matchScopeRaw || scope == "" {
+		return m.text
+	}
+	if masked, ok := m.masked[scope]; ok {
+		return masked
+	}
+	if m.flags == nil {
+		m.flags = wikitextRegions(m.text)
+	}
+
+	masked := []byte(m.text)
+	for i, flags := range m.flags {
+		if masked[i] != '\n' && !inMatchScope(flags, scope) {
+			masked[i] = maskByte
+		}
+	}
+	m.masked[scope] = string(masked)
+	return m.masked[scope]
+}
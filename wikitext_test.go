@@ -0,0 +1,77 @@
+package main
+
+//
+// Yapperbot-Scantag, the page scanning and tagging bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const maskTestArticle string = `{{Infobox thing|name=Thing|note=claim}}
+A claim.<ref name="a">{{cite web|url=http://x.blogspot.com|title=Claim}}</ref><!-- claim -->
+<nowiki>claim</nowiki> <ref name="b" /> <pre>claim</pre> <span style="claim">ok</span>
+== Claims ==
+More text.`
+
+// visibleWords returns the words left in masked text, to keep the expected values readable
+func visibleWords(masked string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(masked, string(maskByte), " ")), " ")
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  string
+	}{
+		{matchScopeRaw, strings.Join(strings.Fields(maskTestArticle), " ")},
+		{matchScopeProse, "A claim. ok More text."},
+		{matchScopeRefs, "{{cite web|url=http://x.blogspot.com|title=Claim}}"},
+		{matchScopeTemplates, "{{Infobox thing|name=Thing|note=claim}} {{cite web|url=http://x.blogspot.com|title=Claim}}"},
+		{matchScopeHeadings, "== Claims =="},
+	}
+
+	masker := newTextMasker(maskTestArticle)
+	for _, test := range tests {
+		t.Run(test.scope, func(t *testing.T) {
+			masked := masker.mask(test.scope)
+			if len(masked) != len(maskTestArticle) || strings.Count(masked, "\n") != strings.Count(maskTestArticle, "\n") {
+				t.Fatalf("Masking moved things around:\n%q", masked)
+			}
+			if got := visibleWords(masked); got != test.want {
+				t.Errorf("mask left %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchArticleProseScope(t *testing.T) {
+	rule := STRegex{ID: "claim", Key: `(\w+) claim`, Regex: regexp.MustCompile(`(?i)(\w+) claim`), Prefix: "{{Tag|${1}}}\n", Detected: "a claim", MatchScope: matchScopeProse}
+
+	text := "<!-- a hidden claim -->{{Quote|a quoted claim}} Then a real claim."
+	matches, _ := matchArticle(fetchedPage{title: "Test", text: text}, map[string]STRegex{rule.ID: rule}, false)
+	if len(matches) != 1 || matches[0].prefix != "{{Tag|real}}\n" {
+		t.Errorf("matchArticle gave %+v, want one match tagging the real claim", matches)
+	}
+
+	matches, _ = matchArticle(fetchedPage{title: "Test", text: "<!-- a hidden claim -->"}, map[string]STRegex{rule.ID: rule}, false)
+	if len(matches) != 0 {
+		t.Errorf("matchArticle matched a claim in a comment: %+v", matches)
+	}
+}